@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// -export-adapter-seen exports which adapters heard each device within -device-timeout, as
+// btle_exporter_device_adapter_seen{adapter} 1, a coverage matrix for placing adapters.
+// Devices only one adapter hears are the ones a dongle failure would lose.
+
+type adapterSeenState struct {
+	last   time.Time
+	labels prometheus.Labels // As exported, nil until the device was decoded
+}
+
+var adapterSeenMap = make(map[string]map[string]*adapterSeenState) // MAC -> Adapter -> When it last heard the device
+var adapterSeenMutex = &sync.RWMutex{}
+
+var metricsDeviceAdapterSeenGauge = newDeviceGaugeVec(deviceGaugeOpts{
+	Name:        "adapter_seen",
+	Help:        "Set to 1 for every adapter that heard the device within -device-timeout",
+	ExtraLabels: []string{"adapter"},
+})
+
+func recordAdapterSeen(mac string, adapterID string, now time.Time) { // Every advertisement, decoded or not, so keep it cheap
+	adapterSeenMutex.Lock()
+	defer adapterSeenMutex.Unlock()
+	adapters, ok := adapterSeenMap[mac]
+	if !ok {
+		adapters = make(map[string]*adapterSeenState)
+		adapterSeenMap[mac] = adapters
+	}
+	if seen, ok := adapters[adapterID]; ok {
+		seen.last = now
+	} else {
+		adapters[adapterID] = &adapterSeenState{last: now}
+	}
+}
+
+func exportAdapterSeen(mac string, label prometheus.Labels) { // Called with the device labels of each decoded reading
+	adapterSeenMutex.Lock()
+	defer adapterSeenMutex.Unlock()
+	for adapterID, seen := range adapterSeenMap[mac] {
+		labels := prometheus.Labels{"adapter": adapterID}
+		for k, v := range label {
+			labels[k] = v
+		}
+		if seen.labels != nil && !sameLabels(seen.labels, labels) { // Renamed, don't leave the old series behind
+			metricsDeviceAdapterSeenGauge.Delete(seen.labels)
+		}
+		seen.labels = labels
+		metricsDeviceAdapterSeenGauge.Set(labels, 1)
+	}
+}
+
+func expireAdapterSeen(now time.Time) { // Drops the adapters that haven't heard a device within -device-timeout
+	adapterSeenMutex.Lock()
+	defer adapterSeenMutex.Unlock()
+	for mac, adapters := range adapterSeenMap {
+		for adapterID, seen := range adapters {
+			if now.Sub(seen.last) <= flagDeviceTimeout {
+				continue
+			}
+			if seen.labels != nil {
+				metricsDeviceAdapterSeenGauge.Delete(seen.labels)
+			}
+			delete(adapters, adapterID)
+		}
+		if len(adapters) == 0 {
+			delete(adapterSeenMap, mac)
+		}
+	}
+}
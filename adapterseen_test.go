@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAdapterSeen(t *testing.T) {
+	defer func(timeout time.Duration) { flagDeviceTimeout = timeout }(flagDeviceTimeout)
+	flagDeviceTimeout = 15 * time.Minute
+	mac := "aa:bb:cc:dd:ee:62"
+	label := deviceLabels(mac, "Kitchen", "ATC")
+	seen := func(adapterID string) prometheus.Labels {
+		labels := prometheus.Labels{"adapter": adapterID}
+		for k, v := range label {
+			labels[k] = v
+		}
+		return labels
+	}
+	now := time.Now()
+	recordAdapterSeen(mac, "hci0", now)
+	recordAdapterSeen(mac, "hci1", now.Add(-10*time.Minute))
+	exportAdapterSeen(mac, label)
+	expireAdapterSeen(now.Add(10 * time.Minute)) // hci1 last heard it 20 minutes ago
+	if !metricsDeviceAdapterSeenGauge.vecs[0].Delete(seen("hci0")) {
+		t.Errorf("hci0 : series missing")
+	}
+	if metricsDeviceAdapterSeenGauge.vecs[0].Delete(seen("hci1")) {
+		t.Errorf("hci1 : series still present after -device-timeout")
+	}
+	expireAdapterSeen(now.Add(time.Hour))
+	adapterSeenMutex.RLock()
+	_, tracked := adapterSeenMap[mac]
+	adapterSeenMutex.RUnlock()
+	if tracked {
+		t.Errorf("device still tracked after every adapter timed out")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// -alert-rule thresholds (e.g. "temperature>-15", or "a4:c1:38:00:00:01/temperature>-15" for a
+// single device) run -on-alert-command when a reading crosses them, for local actuation
+// (GPIO, buzzer) without a separate automation system. A rule fires when a device enters
+// the breached state, and again at most every -alert-debounce while it stays there.
+
+const alertCommandTimeout = 30 * time.Second
+
+var alertFields = map[string]func(r *deviceReading) *float64{
+	"temperature":    func(r *deviceReading) *float64 { return r.TemperatureCelsius },
+	"humidity":       func(r *deviceReading) *float64 { return r.HumidityPercent },
+	"battery":        func(r *deviceReading) *float64 { return r.BatteryPercent },
+	"co2":            func(r *deviceReading) *float64 { return r.CO2PPM },
+	"pressure":       func(r *deviceReading) *float64 { return r.PressurePascal },
+	"voc":            func(r *deviceReading) *float64 { return r.VOCIndex },
+	"gravity":        func(r *deviceReading) *float64 { return r.SpecificGravity },
+	"illuminance":    func(r *deviceReading) *float64 { return r.IlluminanceLux },
+	"dewpoint":       func(r *deviceReading) *float64 { return r.DewPointCelsius },
+	"heart_rate":     func(r *deviceReading) *float64 { return r.HeartRateBPM },
+	"acceleration_x": func(r *deviceReading) *float64 { return r.AccelerationXG },
+	"acceleration_y": func(r *deviceReading) *float64 { return r.AccelerationYG },
+	"acceleration_z": func(r *deviceReading) *float64 { return r.AccelerationZG },
+}
+
+type alertRule struct {
+	text      string
+	device    string // Mac or name, empty for every device
+	field     string
+	above     bool // > rather than <
+	threshold float64
+}
+
+type alertEvent struct {
+	rule  *alertRule
+	mac   string
+	name  string
+	model string
+	value float64
+}
+
+var alertRules []*alertRule
+var alertFiredMap = make(map[string]time.Time) // MAC + Rule -> Last fired, present while breached
+var alertFiredMutex = &sync.RWMutex{}
+
+var metricsAlertCommandFailureCount = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "btle_exporter_alert_command_failure_count",
+	Help: "The total number of -on-alert-command runs that failed or exited non-zero",
+})
+
+func parseAlertRules(rules string) ([]*alertRule, error) {
+	var parsed []*alertRule
+	for _, text := range strings.Split(rules, ",") {
+		if text = strings.TrimSpace(text); len(text) == 0 {
+			continue
+		}
+		rule := &alertRule{text: text}
+		expression := text
+		if i := strings.LastIndex(text, "/"); i >= 0 {
+			rule.device, expression = strings.ToLower(text[:i]), text[i+1:]
+		}
+		i := strings.IndexAny(expression, "<>")
+		if i < 0 {
+			return nil, fmt.Errorf("rule %q has no < or >", text)
+		}
+		rule.field, rule.above = expression[:i], expression[i] == '>'
+		if _, ok := alertFields[rule.field]; !ok {
+			return nil, fmt.Errorf("rule %q has unknown field %q", text, rule.field)
+		}
+		threshold, err := strconv.ParseFloat(expression[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q has bad threshold : %v", text, err)
+		}
+		rule.threshold = threshold
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+func (rule *alertRule) breached(r *deviceReading) (float64, bool) {
+	if len(rule.device) > 0 && rule.device != r.Mac && rule.device != strings.ToLower(r.Name) {
+		return 0, false
+	}
+	value := alertFields[rule.field](r)
+	if value == nil {
+		return 0, false
+	}
+	if rule.above {
+		return *value, *value > rule.threshold
+	}
+	return *value, *value < rule.threshold
+}
+
+func evaluateAlerts(r *deviceReading, now time.Time) []alertEvent {
+	var events []alertEvent
+	alertFiredMutex.Lock()
+	defer alertFiredMutex.Unlock()
+	for _, rule := range alertRules {
+		if alertFields[rule.field](r) == nil { // Not in this reading, keep the state as is
+			continue
+		}
+		key := r.Mac + " " + rule.text
+		value, breached := rule.breached(r)
+		if !breached {
+			delete(alertFiredMap, key) // Back in range, the next breach fires right away
+			continue
+		}
+		if last, ok := alertFiredMap[key]; ok && now.Sub(last) < flagAlertDebounce {
+			continue
+		}
+		alertFiredMap[key] = now
+		events = append(events, alertEvent{rule: rule, mac: r.Mac, name: r.Name, model: r.Model, value: value})
+	}
+	return events
+}
+
+func checkAlerts(r *deviceReading) {
+	if len(alertRules) == 0 {
+		return
+	}
+	for _, event := range evaluateAlerts(r, time.Now()) {
+		logInfo("[%s] Alert %s fired with %s %g", event.mac, event.rule.text, event.rule.field, event.value)
+		if len(flagOnAlertCommand) > 0 {
+			go runAlertCommand(event) // Never hold up the scan for the command
+		}
+	}
+}
+
+func runAlertCommand(event alertEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), alertCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", flagOnAlertCommand)
+	cmd.Env = append(os.Environ(),
+		"BTLE_MAC="+event.mac,
+		"BTLE_NAME="+event.name,
+		"BTLE_MODEL="+event.model,
+		"BTLE_RULE="+event.rule.text,
+		"BTLE_FIELD="+event.rule.field,
+		"BTLE_VALUE="+strconv.FormatFloat(event.value, 'f', -1, 64),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		metricsAlertCommandFailureCount.Inc()
+		logWarn("[%s] Alert command for %s failed - %v : %s", event.mac, event.rule.text, err, strings.TrimSpace(string(output)))
+		return
+	}
+	logInfo("[%s] Alert command for %s exited 0", event.mac, event.rule.text)
+}
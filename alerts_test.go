@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAlertRules(t *testing.T) {
+	rules, err := parseAlertRules("temperature>-15, A4:C1:38:00:00:01/humidity<20")
+	if err != nil {
+		t.Fatalf("parse : %v", err)
+	}
+	if len(rules) != 2 || rules[0].field != "temperature" || !rules[0].above || rules[0].threshold != -15 {
+		t.Fatalf("got %+v", rules)
+	}
+	if rules[1].device != "a4:c1:38:00:00:01" || rules[1].field != "humidity" || rules[1].above || rules[1].threshold != 20 {
+		t.Errorf("got %+v", rules[1])
+	}
+	for _, bad := range []string{"temperature", "wind>3", "temperature>warm"} {
+		if _, err := parseAlertRules(bad); err == nil {
+			t.Errorf("parse %q : got no error", bad)
+		}
+	}
+}
+
+func TestEvaluateAlertsDebounce(t *testing.T) {
+	defer func(rules []*alertRule, debounce time.Duration) { alertRules, flagAlertDebounce = rules, debounce }(alertRules, flagAlertDebounce)
+	alertRules, _ = parseAlertRules("temperature>-15")
+	flagAlertDebounce = 10 * time.Minute
+	start := time.Now()
+	reading := func(temperature float64) *deviceReading {
+		return &deviceReading{Mac: "aa:bb:cc:dd:ee:10", TemperatureCelsius: &temperature}
+	}
+	for i, step := range []struct {
+		temperature float64
+		after       time.Duration
+		fires       bool
+	}{
+		{-18, 0, false},
+		{-12, time.Minute, true},       // Freezer warming
+		{-11, 2 * time.Minute, false},  // Still warm, debounced
+		{-10, 12 * time.Minute, true},  // Still warm after the debounce
+		{-18, 13 * time.Minute, false}, // Recovered
+		{-14, 14 * time.Minute, true},  // Warming again fires right away
+	} {
+		if got := len(evaluateAlerts(reading(step.temperature), start.Add(step.after))) > 0; got != step.fires {
+			t.Errorf("step %d (%gC) : got fired %v, want %v", i, step.temperature, got, step.fires)
+		}
+	}
+}
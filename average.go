@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// -average-window exports the mean of the environmental readings (temperature, humidity,
+// pressure, CO2, VOC and dew point) each device sent within the window, instead of the
+// latest frame, smoothing out sensors that jitter between frames. 0 exports raw readings.
+
+type averageSample struct {
+	at    time.Time
+	value float64
+}
+
+var averageMap = make(map[string][][]averageSample) // MAC -> Samples within -average-window, per averagedFields entry
+var averageMutex = &sync.RWMutex{}
+
+func averagedFields(s *SensorData) []*float64 { // In a fixed order, the index keys averageMap
+	return []*float64{
+		&s.TemperatureCelsius,
+		&s.HumidityPercent,
+		&s.PressurePascal,
+		&s.CO2PPM,
+		&s.VOCIndex,
+		&s.DewPointCelsius,
+	}
+}
+
+func averageReadings(mac string, sensorData *SensorData, now time.Time) { // Replaces each reading with its mean over -average-window
+	averageMutex.Lock()
+	defer averageMutex.Unlock()
+	fields := averagedFields(sensorData)
+	samples, ok := averageMap[mac]
+	if !ok {
+		samples = make([][]averageSample, len(fields))
+		averageMap[mac] = samples
+	}
+	for i, field := range fields {
+		if *field == undefined {
+			continue
+		}
+		samples[i] = append(pruneSamples(samples[i], now), averageSample{at: now, value: *field})
+		var sum float64
+		for _, sample := range samples[i] {
+			sum += sample.value
+		}
+		*field = sum / float64(len(samples[i]))
+	}
+}
+
+func pruneSamples(samples []averageSample, now time.Time) []averageSample { // Drops the samples older than -average-window
+	keep := 0
+	for keep < len(samples) && now.Sub(samples[keep].at) > flagAverageWindow {
+		keep++
+	}
+	return samples[keep:]
+}
+
+func expireAverages(now time.Time) { // Forgets the devices with no sample left within -average-window
+	averageMutex.Lock()
+	defer averageMutex.Unlock()
+	for mac, samples := range averageMap {
+		empty := true
+		for i := range samples {
+			samples[i] = pruneSamples(samples[i], now)
+			empty = empty && len(samples[i]) == 0
+		}
+		if empty {
+			delete(averageMap, mac)
+		}
+	}
+}
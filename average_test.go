@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAverageReadings(t *testing.T) {
+	defer func(window time.Duration) { flagAverageWindow = window }(flagAverageWindow)
+	flagAverageWindow = 5 * time.Minute
+	mac := "aa:bb:cc:dd:ee:63"
+	now := time.Now()
+	for i, step := range []struct {
+		at          time.Duration
+		temperature float64
+		humidity    float64
+		want        float64 // Temperature
+		wantHum     float64
+	}{
+		{0, 20.0, 50, 20.0, 50},
+		{time.Minute, 20.6, undefined, 20.3, undefined}, // A frame without humidity leaves its samples alone
+		{2 * time.Minute, 20.3, 52, 20.3, 51},
+		{8 * time.Minute, 21.0, 54, 21.0, 54}, // Everything so far is outside the window
+	} {
+		sensorData := newSensorData()
+		sensorData.TemperatureCelsius, sensorData.HumidityPercent = step.temperature, step.humidity
+		averageReadings(mac, sensorData, now.Add(step.at))
+		if diff := sensorData.TemperatureCelsius - step.want; diff > 0.001 || diff < -0.001 {
+			t.Errorf("step %d : got temperature %g, want %g", i, sensorData.TemperatureCelsius, step.want)
+		}
+		if sensorData.HumidityPercent != step.wantHum {
+			t.Errorf("step %d : got humidity %g, want %g", i, sensorData.HumidityPercent, step.wantHum)
+		}
+		if sensorData.BatteryPercent != undefined {
+			t.Errorf("step %d : battery set to %g", i, sensorData.BatteryPercent)
+		}
+	}
+	expireAverages(now.Add(time.Hour))
+	averageMutex.RLock()
+	_, tracked := averageMap[mac]
+	averageMutex.RUnlock()
+	if tracked {
+		t.Errorf("device still tracked after its samples left the window")
+	}
+}
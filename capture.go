@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var captureFile *os.File
+var captureSize int64
+var captureMutex = &sync.Mutex{}
+
+// Capture files hold one advertisement per line, as whitespace separated fields :
+//
+//	<timestamp (RFC 3339)> <mac> <rssi> <payload (hex)>
+//
+// e.g. "2024-01-02T15:04:05.123Z a4:c1:38:d0:2c:ec -67 02010610161a18a4c138d02cec00f43c420bb80a".
+// Empty lines and lines starting with # are skipped. -capture writes every advertisement
+// heard in this format, and -replay feeds a capture file through the scan handler, so a
+// decode problem can be reproduced without the device.
+
+type capturedFrame struct {
+	time time.Time
+	mac  string
+	rssi int
+	data []byte
+}
+
+func parseCaptureLine(line string) (*capturedFrame, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	t, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad timestamp : %v", err)
+	}
+	if _, err := net.ParseMAC(fields[1]); err != nil {
+		return nil, fmt.Errorf("bad mac %q", fields[1])
+	}
+	rssi, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad rssi : %v", err)
+	}
+	data, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("bad payload : %v", err)
+	}
+	return &capturedFrame{time: t, mac: strings.ToLower(fields[1]), rssi: rssi, data: data}, nil
+}
+
+func replayFile(path string) error { // Feeds every frame through the scan handler, as fast as it can
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	handler := adapterScanHandler("replay")
+	scanner := bufio.NewScanner(f)
+	lineNumber, frames := 0, 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		frame, err := parseCaptureLine(line)
+		if err != nil {
+			logWarn("Skipping %s line %d - %v", path, lineNumber, err)
+			continue
+		}
+		handler(&simulatedAdvertisement{addr: frame.mac, rssi: frame.rssi, data: frame.data})
+		frames++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	logInfo("Replayed %d advertisements from %s", frames, path)
+	return nil
+}
+
+func formatCaptureLine(t time.Time, mac string, rssi int, data []byte) string {
+	return fmt.Sprintf("%s %s %d %x\n", t.UTC().Format(time.RFC3339Nano), mac, rssi, data)
+}
+
+func openCaptureFile() error {
+	f, err := os.OpenFile(flagCapture, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	captureFile, captureSize = f, info.Size()
+	return nil
+}
+
+func writeCapture(mac string, rssi int, data []byte) { // Appends to -capture, keeping one rotated file of -capture-max-size
+	line := formatCaptureLine(time.Now(), mac, rssi, data)
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+	if captureFile == nil {
+		return
+	}
+	if flagCaptureMaxSize > 0 && captureSize+int64(len(line)) > flagCaptureMaxSize {
+		captureFile.Close()
+		captureFile = nil
+		if err := os.Rename(flagCapture, flagCapture+".1"); err != nil {
+			logWarn("Failed to rotate %s - %v", flagCapture, err)
+		}
+		if err := openCaptureFile(); err != nil {
+			logError("Failed to reopen %s, capture stopped - %v", flagCapture, err)
+			return
+		}
+	}
+	n, err := captureFile.WriteString(line)
+	captureSize += int64(n)
+	if err != nil {
+		logWarn("Failed to write %s - %v", flagCapture, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCaptureLine(t *testing.T) {
+	frame, err := parseCaptureLine("2024-01-02T15:04:05.123Z A4:C1:38:D0:2C:EC -67 02010610161a18a4c138d02cec00f43c420bb80a")
+	if err != nil {
+		t.Fatalf("parse : %v", err)
+	}
+	if frame.mac != "a4:c1:38:d0:2c:ec" || frame.rssi != -67 || frame.time.Second() != 5 {
+		t.Errorf("got %+v", frame)
+	}
+	if !bytes.Equal(frame.data[:3], []byte{0x02, 0x01, 0x06}) || len(frame.data) != 20 {
+		t.Errorf("got payload %x", frame.data)
+	}
+	for _, bad := range []string{
+		"2024-01-02T15:04:05Z a4:c1:38:d0:2c:ec -67",         // Missing payload
+		"yesterday a4:c1:38:d0:2c:ec -67 020106",             // Timestamp
+		"2024-01-02T15:04:05Z a4:c1:38 -67 020106",           // Mac
+		"2024-01-02T15:04:05Z a4:c1:38:d0:2c:ec loud 020106", // RSSI
+		"2024-01-02T15:04:05Z a4:c1:38:d0:2c:ec -67 02010",   // Odd hex
+	} {
+		if _, err := parseCaptureLine(bad); err == nil {
+			t.Errorf("parse %q : got no error", bad)
+		}
+	}
+}
+
+func TestWriteCaptureRoundTripAndRotation(t *testing.T) {
+	defer func(path string, maxSize int64) { flagCapture, flagCaptureMaxSize = path, maxSize }(flagCapture, flagCaptureMaxSize)
+	flagCapture = filepath.Join(t.TempDir(), "capture.txt")
+	flagCaptureMaxSize = 200 // Two lines fit
+	if err := openCaptureFile(); err != nil {
+		t.Fatalf("open : %v", err)
+	}
+	defer func() { captureFile.Close(); captureFile = nil }()
+	data := []byte{0x02, 0x01, 0x06, 0x03, 0x02, 0x1a, 0x18}
+	for i := 0; i < 3; i++ {
+		writeCapture("a4:c1:38:d0:2c:ec", -60-i, data)
+	}
+	rotated, err := os.ReadFile(flagCapture + ".1")
+	if err != nil {
+		t.Fatalf("rotated file : %v", err)
+	}
+	current, err := os.ReadFile(flagCapture)
+	if err != nil {
+		t.Fatalf("current file : %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(rotated)), "\n")
+	if len(lines) != 2 || strings.Count(string(current), "\n") != 1 {
+		t.Fatalf("got %d rotated lines and current %q, want 2 and 1", len(lines), current)
+	}
+	frame, err := parseCaptureLine(strings.TrimSpace(string(current)))
+	if err != nil {
+		t.Fatalf("parse : %v", err)
+	}
+	if frame.mac != "a4:c1:38:d0:2c:ec" || frame.rssi != -62 || !bytes.Equal(frame.data, data) {
+		t.Errorf("got %+v", frame)
+	}
+}
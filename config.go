@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// -config reads a yaml file with the settings that differ between instances, so they
+// live in one place :
+//
+//	metrics-listen: 0.0.0.0:9978
+//	adapterID: hci0,hci1
+//	device-timeout: 30m
+//	names:
+//	  a4:c1:38:d0:2c:ec: bedroom
+//	models:
+//	  a4:c1:38:d0:2c:ec: LYWSD03MMC
+//
+// Flags given on the command line win over the file. The names are the base the
+// -names-csv files are merged over, and models relabel what a device is exported as
+// (e.g. a LYWSD03MMC flashed with the ATC firmware). It is only read at startup.
+
+type fileConfig struct {
+	MetricsListen string            `yaml:"metrics-listen"`
+	AdapterID     string            `yaml:"adapterID"`
+	DeviceTimeout string            `yaml:"device-timeout"`
+	Names         map[string]string `yaml:"names"`  // MAC -> Name
+	Models        map[string]string `yaml:"models"` // MAC -> Model
+}
+
+var configNames = make(map[string]string)    // From -config, -names-csv entries override them
+var modelOverrides = make(map[string]string) // From -config, MAC -> Model
+
+func loadConfig(configFile string) (*fileConfig, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var config fileConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)                                                  // A misspelt key would otherwise be silently ignored
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) { // EOF is an empty file
+		return nil, err
+	}
+	if len(config.MetricsListen) > 0 {
+		if _, _, err := net.SplitHostPort(config.MetricsListen); err != nil {
+			return nil, fmt.Errorf("bad metrics-listen %q - %v", config.MetricsListen, err)
+		}
+	}
+	if config.Names, err = lowerMacKeys(config.Names, "names"); err != nil {
+		return nil, err
+	}
+	if config.Models, err = lowerMacKeys(config.Models, "models"); err != nil {
+		return nil, err
+	}
+	for mac, model := range config.Models {
+		if len(strings.TrimSpace(model)) == 0 {
+			return nil, fmt.Errorf("empty model for %s", mac)
+		}
+	}
+	return &config, nil
+}
+
+func lowerMacKeys(m map[string]string, section string) (map[string]string, error) { // .Addr always returns lower case
+	lowered := make(map[string]string, len(m))
+	for mac, value := range m {
+		if _, err := net.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("bad mac %q in %s", mac, section)
+		}
+		lowered[strings.ToLower(mac)] = value
+	}
+	return lowered, nil
+}
+
+func applyConfig(flags *flag.FlagSet, config *fileConfig) error { // Called after parsing, fills in the flags not given on the command line
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"metrics-listen", config.MetricsListen},
+		{"adapterID", config.AdapterID},
+		{"device-timeout", config.DeviceTimeout},
+	} {
+		if len(setting.value) == 0 || explicit[setting.name] {
+			continue
+		}
+		if err := flags.Set(setting.name, setting.value); err != nil { // The flag's own parsing, e.g. durations
+			return fmt.Errorf("bad %s %q - %v", setting.name, setting.value, err)
+		}
+	}
+	configNames = config.Names
+	modelOverrides = config.Models
+	return nil
+}
+
+func applyModelOverride(mac string, sensorData *SensorData) { // Only readings that get exported, an override can't make sense of unknown data
+	if model, ok := modelOverrides[mac]; ok && sensorData.Model != "Unknown" && !ignoredModels[sensorData.Model] {
+		sensorData.Model = model
+	}
+}
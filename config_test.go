@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"empty", "", false},
+		{"full", "metrics-listen: 127.0.0.1:9978\nadapterID: hci1\ndevice-timeout: 30m\nnames:\n  A4:C1:38:D0:2C:EC: bedroom\nmodels:\n  a4:c1:38:d0:2c:ec: LYWSD03MMC\n", false},
+		{"misspelt key", "metrics_listen: 127.0.0.1:9978\n", true},
+		{"bad listen", "metrics-listen: 9978\n", true},
+		{"bad mac", "names:\n  bedroom: a4:c1:38:d0:2c:ec\n", true},
+		{"empty model", "models:\n  a4:c1:38:d0:2c:ec: \"\"\n", true},
+		{"not yaml", "names: [\n", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			configFile := filepath.Join(dir, tc.name+".yaml")
+			if err := os.WriteFile(configFile, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig(configFile)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got err %v, want err %v", err, tc.wantErr)
+			}
+		})
+	}
+	if _, err := loadConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("missing file : got no error")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	defer func(listen, adapterID string, timeout time.Duration, names, models map[string]string) {
+		flagMetricsListen, flagAdapterID, flagDeviceTimeout, configNames, modelOverrides = listen, adapterID, timeout, names, models
+	}(flagMetricsListen, flagAdapterID, flagDeviceTimeout, configNames, modelOverrides)
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "btle_exporter.yaml")
+	content := "metrics-listen: 127.0.0.1:9000\nadapterID: hci1\ndevice-timeout: 30m\nnames:\n  A4:C1:38:D0:2C:EC: bedroom\nmodels:\n  a4:c1:38:d0:2c:ec: LYWSD03MMC\n"
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.StringVar(&flagMetricsListen, "metrics-listen", "0.0.0.0:9978", "")
+	flags.StringVar(&flagAdapterID, "adapterID", "hci0", "")
+	flags.DurationVar(&flagDeviceTimeout, "device-timeout", 15*time.Minute, "")
+	if err := flags.Parse([]string{"-adapterID", "hci2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(flags, config); err != nil {
+		t.Fatal(err)
+	}
+	if flagMetricsListen != "127.0.0.1:9000" || flagDeviceTimeout != 30*time.Minute {
+		t.Errorf("got %s %s, want 127.0.0.1:9000 30m0s from the file", flagMetricsListen, flagDeviceTimeout)
+	}
+	if flagAdapterID != "hci2" {
+		t.Errorf("adapterID : got %s, want hci2 from the command line", flagAdapterID)
+	}
+	if configNames["a4:c1:38:d0:2c:ec"] != "bedroom" {
+		t.Errorf("names : got %v, want the mac lower cased", configNames)
+	}
+	for _, tc := range []struct {
+		model, want string
+	}{
+		{"ATC", "LYWSD03MMC"},
+		{"Unknown", "Unknown"},
+		{"AppleContinuity", "AppleContinuity"},
+	} {
+		sensorData := newSensorData()
+		sensorData.Model = tc.model
+		applyModelOverride("a4:c1:38:d0:2c:ec", sensorData)
+		if sensorData.Model != tc.want {
+			t.Errorf("override of %s : got %s, want %s", tc.model, sensorData.Model, tc.want)
+		}
+	}
+	config.DeviceTimeout = "soon"
+	timeoutOnly := flag.NewFlagSet("test", flag.ContinueOnError)
+	timeoutOnly.DurationVar(&flagDeviceTimeout, "device-timeout", 15*time.Minute, "")
+	config.MetricsListen, config.AdapterID = "", ""
+	if err := applyConfig(timeoutOnly, config); err == nil {
+		t.Errorf("device-timeout soon : got no error")
+	}
+}
+
+func TestConfigNamesUnderNamesCSV(t *testing.T) {
+	defer func(files string, names, loaded map[string]string) {
+		flagNamesCSVFile, configNames, namesMap = files, names, loaded
+	}(flagNamesCSVFile, configNames, namesMap)
+	configNames = map[string]string{"a4:c1:38:00:00:01": "bedroom", "a4:c1:38:00:00:02": "kitchen"}
+	flagNamesCSVFile = ""
+	if count, err := reloadNames(); err != nil || count != 2 || rawMacName("a4:c1:38:00:00:01") != "bedroom" {
+		t.Errorf("without -names-csv : got %d names, err %v, want the 2 from -config", count, err)
+	}
+	flagNamesCSVFile = filepath.Join(t.TempDir(), "names.csv")
+	if err := os.WriteFile(flagNamesCSVFile, []byte("a4:c1:38:00:00:02,pantry\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadNames(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rawMacName("a4:c1:38:00:00:02"); got != "pantry" {
+		t.Errorf("a4:c1:38:00:00:02 : got %q, want pantry from -names-csv", got)
+	}
+	if got := rawMacName("a4:c1:38:00:00:01"); got != "bedroom" {
+		t.Errorf("a4:c1:38:00:00:01 : got %q, want bedroom from -config", got)
+	}
+}
@@ -0,0 +1,38 @@
+package decoders
+
+// ATC decodes the environmental sensing service (0x181A) frames of the custom Xiaomi
+// thermometer firmwares, in both the atc1441 and the pvvx custom format. The service data
+// length tells the variants apart, and the model says which one it was (ATC with one
+// byte humidity, ATC2 with two, pvvx).
+type ATC struct{}
+
+func (ATC) Match(adType byte, uuid uint16, data []byte) bool {
+	return adType == 0x16 && uuid == 0x181A && len(data) >= 15
+}
+
+func (ATC) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	if len(data) == 17 { // pvvx custom format (little endian) / https://github.com/pvvx/ATC_MiThermometer#custom-format-all-data-little-endian
+		sensorData.ID = int(data[15])
+		sensorData.Model = "pvvx"
+		sensorData.TemperatureCelsius = float64(int16(uint16(data[9])<<8|uint16(data[8]))) / divisor("pvvx", "tempScale")
+		sensorData.HumidityPercent = float64(uint16(data[11])<<8|uint16(data[10])) / divisor("pvvx", "humidityScale")
+		sensorData.BatteryPercent = float64(data[14])
+		return sensorData, nil
+	}
+	if len(data) == 16 { // Newer atc1441 builds, with two byte humidity in hundredths
+		sensorData.ID = int(data[15])
+		sensorData.Model = "ATC2"
+		sensorData.TemperatureCelsius = float64(int16(uint16(data[8])<<8|uint16(data[9]))) / divisor("ATC2", "tempScale") // Signed, big endian
+		sensorData.HumidityPercent = float64(uint16(data[10])<<8|uint16(data[11])) / divisor("ATC2", "humidityScale")
+		sensorData.BatteryPercent = float64(data[12])
+		return sensorData, nil
+	}
+	// atc1441 format, also emitted by pvvx / https://github.com/atc1441/ATC_MiThermometer
+	sensorData.ID = int(data[14])
+	sensorData.Model = "ATC"
+	sensorData.TemperatureCelsius = float64(int16(uint16(data[8])<<8|uint16(data[9]))) / divisor("ATC", "tempScale") // Signed, big endian
+	sensorData.HumidityPercent = float64(data[10]) / divisor("ATC", "humidityScale")
+	sensorData.BatteryPercent = float64(data[11])
+	return sensorData, nil
+}
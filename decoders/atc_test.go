@@ -0,0 +1,12 @@
+package decoders
+
+import "testing"
+
+func TestATC(t *testing.T) {
+	runDecodeCases(t, 0x16, []decodeCase{
+		{"atc1441", "1a18a4c13800000200f43c420bb80a", SensorData{Model: "ATC", TemperatureCelsius: 24.4, HumidityPercent: 60, BatteryPercent: 66}, false},
+		{"atc1441 negative", "1a18a4c138000002ffce3c420bb80a", SensorData{Model: "ATC", TemperatureCelsius: -5, HumidityPercent: 60, BatteryPercent: 66}, false},
+		{"atc1441 two byte humidity", "1a18a4c13800000200f417a5420bb80a", SensorData{Model: "ATC2", TemperatureCelsius: 24.4, HumidityPercent: 60.53, BatteryPercent: 66}, false},
+		{"pvvx custom", "1a1807000038c1a4f3fdd61f860b552104", SensorData{Model: "pvvx", TemperatureCelsius: -5.25, HumidityPercent: 81.5, BatteryPercent: 85}, false},
+	})
+}
@@ -0,0 +1,87 @@
+package decoders
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sensors that only report their battery voltage get a percent from a piecewise linear
+// discharge curve. A CR2032 holds close to 3V for most of its life and then drops off
+// quickly, so a straight line between full and empty reads far too low early on.
+
+type batteryPoint struct {
+	volts   float64
+	percent float64
+}
+
+var defaultBatteryCurve = []batteryPoint{ // CR2032 under a light load, highest voltage first
+	{3.0, 100},
+	{2.9, 80},
+	{2.8, 60},
+	{2.7, 40},
+	{2.6, 25},
+	{2.5, 15},
+	{2.4, 8},
+	{2.2, 2},
+	{2.0, 0},
+}
+
+var batteryCurve = defaultBatteryCurve // Only replaced at startup, before any decoding
+
+// SetBatteryCurve replaces the discharge curve, from comma separated <volts>=<percent>
+// points (e.g. "3.2=100,2.9=50,2.5=0" for another chemistry).
+func SetBatteryCurve(spec string) error {
+	var curve []batteryPoint
+	for _, point := range strings.Split(spec, ",") {
+		if point = strings.TrimSpace(point); len(point) == 0 {
+			continue
+		}
+		volts, percent, ok := strings.Cut(point, "=")
+		if !ok {
+			return fmt.Errorf("point %q is not <volts>=<percent>", point)
+		}
+		v, err := strconv.ParseFloat(volts, 64)
+		if err != nil {
+			return fmt.Errorf("point %q has bad volts : %v", point, err)
+		}
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return fmt.Errorf("point %q has bad percent, expected 0 to 100", point)
+		}
+		curve = append(curve, batteryPoint{v, p})
+	}
+	if len(curve) < 2 {
+		return fmt.Errorf("need at least 2 points, got %d", len(curve))
+	}
+	sort.Slice(curve, func(i, j int) bool { return curve[i].volts > curve[j].volts })
+	for i := 1; i < len(curve); i++ {
+		if curve[i].volts == curve[i-1].volts {
+			return fmt.Errorf("%gV appears twice", curve[i].volts)
+		}
+	}
+	batteryCurve = curve
+	return nil
+}
+
+// BatteryPercent maps a battery voltage onto the discharge curve, clamped to its ends.
+func BatteryPercent(volts float64) float64 {
+	if volts >= batteryCurve[0].volts {
+		return batteryCurve[0].percent
+	}
+	for i := 1; i < len(batteryCurve); i++ {
+		upper, lower := batteryCurve[i-1], batteryCurve[i]
+		if volts >= lower.volts {
+			return lower.percent + (volts-lower.volts)/(upper.volts-lower.volts)*(upper.percent-lower.percent)
+		}
+	}
+	return batteryCurve[len(batteryCurve)-1].percent
+}
+
+// FillBatteryPercent sets BatteryPercent from BatteryVoltage when only the voltage was decoded.
+func (s *SensorData) FillBatteryPercent() {
+	if s.BatteryPercent == Undefined && s.BatteryVoltage != Undefined {
+		s.BatteryPercent = BatteryPercent(s.BatteryVoltage)
+	}
+}
@@ -0,0 +1,53 @@
+package decoders
+
+import "testing"
+
+func TestBatteryPercent(t *testing.T) {
+	for _, tc := range []struct {
+		volts, want float64
+	}{
+		{3.3, 100}, // Fresh cells read above the curve
+		{3.0, 100},
+		{2.95, 90},
+		{2.844, 68.8},
+		{2.3, 5},
+		{1.8, 0},
+	} {
+		if got := BatteryPercent(tc.volts); got-tc.want > 0.001 || got-tc.want < -0.001 {
+			t.Errorf("%gV : got %g%%, want %g%%", tc.volts, got, tc.want)
+		}
+	}
+}
+
+func TestSetBatteryCurve(t *testing.T) {
+	defer func(curve []batteryPoint) { batteryCurve = curve }(batteryCurve)
+	if err := SetBatteryCurve("2.5=0, 3.2=100"); err != nil { // Any order
+		t.Fatalf("set : %v", err)
+	}
+	if got := BatteryPercent(2.85); got < 49.999 || got > 50.001 {
+		t.Errorf("2.85V : got %g%%, want 50%%", got)
+	}
+	for _, bad := range []string{"3.2=100", "3.2=100,2.5", "3.2=100,x=0", "3.2=150,2.5=0", "3.2=100,3.2=0"} {
+		if err := SetBatteryCurve(bad); err == nil {
+			t.Errorf("%q : got no error", bad)
+		}
+	}
+}
+
+func TestFillBatteryPercent(t *testing.T) {
+	s := NewSensorData()
+	s.FillBatteryPercent()
+	if s.BatteryPercent != Undefined {
+		t.Errorf("no voltage : got %g%%", s.BatteryPercent)
+	}
+	s.BatteryVoltage = 2.9
+	s.FillBatteryPercent()
+	if s.BatteryPercent != 80 {
+		t.Errorf("2.9V : got %g%%, want 80%%", s.BatteryPercent)
+	}
+	s.BatteryVoltage = 2.0 // A decoded percent wins
+	s.FillBatteryPercent()
+	if s.BatteryPercent != 80 {
+		t.Errorf("decoded percent overwritten, got %g%%", s.BatteryPercent)
+	}
+}
@@ -0,0 +1,93 @@
+package decoders
+
+import "fmt"
+
+// BTHome decodes BTHome v2 service data (0xFCD2), a list of measurement objects, each an
+// object id followed by a little endian value whose size the id implies, as sent by
+// ESPHome, Shelly and many custom firmwares / https://bthome.io/format/
+type BTHome struct{}
+
+var btHomeObjectSizes = map[byte]int{ // Object id -> Value bytes, for every id in the v2 format
+	0x00: 1, 0x01: 1, 0x02: 2, 0x03: 2, 0x04: 3, 0x05: 3, 0x06: 2, 0x07: 2, 0x08: 2, 0x09: 1,
+	0x0A: 3, 0x0B: 3, 0x0C: 2, 0x0D: 2, 0x0E: 2, 0x0F: 1, 0x10: 1, 0x11: 1, 0x12: 2, 0x13: 2,
+	0x14: 2, 0x15: 1, 0x16: 1, 0x17: 1, 0x18: 1, 0x19: 1, 0x1A: 1, 0x1B: 1, 0x1C: 1, 0x1D: 1,
+	0x1E: 1, 0x1F: 1, 0x20: 1, 0x21: 1, 0x22: 1, 0x23: 1, 0x24: 1, 0x25: 1, 0x26: 1, 0x27: 1,
+	0x28: 1, 0x29: 1, 0x2A: 1, 0x2B: 1, 0x2C: 1, 0x2D: 1, 0x2E: 1, 0x2F: 1, 0x3A: 1, 0x3C: 2,
+	0x3D: 2, 0x3E: 4, 0x3F: 2, 0x40: 2, 0x41: 2, 0x42: 3, 0x43: 2, 0x44: 2, 0x45: 2, 0x46: 1,
+	0x47: 2, 0x48: 2, 0x49: 2, 0x4A: 2, 0x4B: 3, 0x4C: 4, 0x4D: 4, 0x4E: 4, 0x4F: 4, 0x50: 4,
+	0x51: 2, 0x52: 2, 0x55: 4, 0x56: 2, 0x57: 1, 0x58: 1, 0x59: 1, 0x5A: 2, 0x5B: 4, 0x5C: 4,
+	0x5D: 1, 0x5E: 2, 0x5F: 2, 0x60: 1, 0xF0: 2, 0xF1: 4, 0xF2: 3,
+}
+
+const (
+	btHomeText = 0x53 // Text and raw objects carry their own length byte
+	btHomeRaw  = 0x54
+)
+
+func (BTHome) Match(adType byte, uuid uint16, data []byte) bool {
+	return adType == 0x16 && uuid == 0xFCD2 && len(data) >= 3
+}
+
+func (BTHome) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "BTHome"
+	deviceInfo := data[2]
+	if version := deviceInfo >> 5; version != 2 {
+		return sensorData, fmt.Errorf("unsupported BTHome version %d", version)
+	}
+	if deviceInfo&0x01 != 0 { // Encrypted, unreadable without the bind key
+		return sensorData, nil
+	}
+	for offset := 3; offset < len(data); {
+		id := data[offset]
+		size, ok := btHomeObjectSizes[id]
+		if id == btHomeText || id == btHomeRaw {
+			if offset+1 >= len(data) {
+				return sensorData, fmt.Errorf("truncated BTHome object 0x%02x at %d", id, offset)
+			}
+			size, ok = int(data[offset+1])+1, true
+		}
+		if !ok { // Newer than this table, its size is unknown and so is where the next object starts. Objects come sorted by id, keep what came before
+			break
+		}
+		if offset+1+size > len(data) {
+			return sensorData, fmt.Errorf("truncated BTHome object 0x%02x at %d", id, offset)
+		}
+		decodeBTHomeObject(sensorData, id, data[offset+1:offset+1+size])
+		offset += 1 + size
+	}
+	return sensorData, nil
+}
+
+func decodeBTHomeObject(sensorData *SensorData, id byte, value []byte) {
+	var unsigned uint32
+	for i := len(value) - 1; i >= 0; i-- { // Little endian
+		unsigned = unsigned<<8 | uint32(value[i])
+	}
+	switch id {
+	case 0x01: // Battery, %
+		sensorData.BatteryPercent = float64(unsigned)
+	case 0x02: // Temperature, 0.01°C
+		sensorData.TemperatureCelsius = float64(int16(unsigned)) / 100
+	case 0x45: // Temperature, 0.1°C
+		sensorData.TemperatureCelsius = float64(int16(unsigned)) / 10
+	case 0x03: // Humidity, 0.01%
+		sensorData.HumidityPercent = float64(unsigned) / 100
+	case 0x2E: // Humidity, 1%
+		sensorData.HumidityPercent = float64(unsigned)
+	case 0x04: // Pressure, 0.01hPa, which is a pascal
+		sensorData.PressurePascal = float64(unsigned)
+	case 0x05: // Illuminance, 0.01lx
+		sensorData.IlluminanceLux = float64(unsigned) / 100
+	case 0x08: // Dew point, 0.01°C
+		sensorData.DewPointCelsius = float64(int16(unsigned)) / 100
+	case 0x0C: // Voltage, 0.001V, the battery's on battery powered devices
+		sensorData.BatteryVoltage = float64(unsigned) / 1000
+	case 0x12: // CO2, ppm
+		sensorData.CO2PPM = float64(unsigned)
+	case 0x21: // Motion, binary
+		if unsigned != 0 {
+			sensorData.Motion = 1
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package decoders
+
+import "testing"
+
+func TestBTHome(t *testing.T) {
+	runDecodeCases(t, 0x16, []decodeCase{ // Examples from the format documentation, and their combinations
+		{"temperature and humidity", "d2fc4002c409035512", SensorData{Model: "BTHome", TemperatureCelsius: 25, HumidityPercent: 46.93}, false},
+		{"packet id, battery, temperature, humidity", "d2fc40000901610245f903bf13", SensorData{Model: "BTHome", BatteryPercent: 97, TemperatureCelsius: -17.23, HumidityPercent: 50.55}, false},
+		{"pressure and illuminance", "d2fc4004138a0105138a14", SensorData{Model: "BTHome", PressurePascal: 100883, IlluminanceLux: 13460.67}, false},
+		{"voltage", "d2fc400c020c", SensorData{Model: "BTHome", BatteryVoltage: 3.074}, false},
+		{"one decimal temperature, one percent humidity", "d2fc4045fdff2e3c", SensorData{Model: "BTHome", TemperatureCelsius: -0.3, HumidityPercent: 60}, false},
+		{"co2, motion and dew point", "d2fc4012e2042101081a06", SensorData{Model: "BTHome", CO2PPM: 1250, Motion: 1, DewPointCelsius: 15.62}, false},
+		{"skips objects it doesn't export", "d2fc400960530568656c6c6f02c409", SensorData{Model: "BTHome", TemperatureCelsius: 25}, false},
+		{"encrypted", "d2fc4102c409035512", SensorData{Model: "BTHome"}, false},
+		{"version 1", "d2fc2002c409", SensorData{Model: "BTHome"}, true},
+		{"stops at an unknown object", "d2fc4002c409fe0103ab12", SensorData{Model: "BTHome", TemperatureCelsius: 25}, false},
+		{"truncated", "d2fc4002c4090355", SensorData{Model: "BTHome"}, true},
+	})
+}
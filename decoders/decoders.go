@@ -0,0 +1,119 @@
+// Package decoders turns the AD structures of btle advertisements into sensor readings,
+// one Decoder per vendor format, so new models don't have to touch the scan loop.
+package decoders
+
+// Undefined marks a reading the advertisement didn't carry.
+const Undefined = -99.9
+
+type SensorData struct {
+	ID                 int
+	Type               int
+	Model              string
+	ModelID            int
+	TemperatureCelsius float64
+	HumidityPercent    float64
+	BatteryPercent     float64
+	BatteryVoltage     float64 // Volts, turned into BatteryPercent by FillBatteryPercent when the percent is missing
+	CO2PPM             float64
+	PressurePascal     float64
+	VOCIndex           float64
+	SpecificGravity    float64
+	Color              string
+	IlluminanceLux     float64
+	DewPointCelsius    float64
+	HeartRateBPM       float64
+	AccelerationX      float64 // In g
+	AccelerationY      float64
+	AccelerationZ      float64
+	TxPowerDBm         float64 // The transmit power the device reports, not the RSSI
+	Motion             float64 // 1 when motion was detected, decays back to 0 after -motion-timeout
+}
+
+func NewSensorData() *SensorData { // Every reading starts out absent
+	sensorData := &SensorData{}
+	sensorData.Model = "Unknown"
+	sensorData.TemperatureCelsius = Undefined
+	sensorData.HumidityPercent = Undefined
+	sensorData.BatteryPercent = Undefined
+	sensorData.BatteryVoltage = Undefined
+	sensorData.CO2PPM = Undefined
+	sensorData.PressurePascal = Undefined
+	sensorData.VOCIndex = Undefined
+	sensorData.SpecificGravity = Undefined
+	sensorData.IlluminanceLux = Undefined
+	sensorData.DewPointCelsius = Undefined
+	sensorData.HeartRateBPM = Undefined
+	sensorData.AccelerationX = Undefined
+	sensorData.AccelerationY = Undefined
+	sensorData.AccelerationZ = Undefined
+	sensorData.TxPowerDBm = Undefined
+	sensorData.Motion = Undefined
+	return sensorData
+}
+
+// A Decoder handles one vendor format. adType is the AD type (0x16 service data, 0xFF
+// manufacturer data, ...), uuid the little endian service uuid or company id in the first
+// two data bytes (0 when shorter), and data the AD structure without its length and type.
+type Decoder interface {
+	Match(adType byte, uuid uint16, data []byte) bool
+	Decode(adType byte, data []byte) (*SensorData, error) // May return a reading along with an error, for its model
+}
+
+var registry []Decoder
+
+// Register adds a decoder, the first registered one that matches an AD structure decodes it.
+func Register(d Decoder) {
+	registry = append(registry, d)
+}
+
+// Find returns the decoder for an AD structure, or nil when none matches.
+func Find(adType byte, data []byte) Decoder {
+	var uuid uint16
+	if len(data) >= 2 {
+		uuid = uint16(data[1])<<8 | uint16(data[0])
+	}
+	for _, d := range registry {
+		if d.Match(adType, uuid, data) {
+			return d
+		}
+	}
+	return nil
+}
+
+// A NamedDecoder handles a format with no company id or uuid to go by, recognised by the
+// local name the device advertises instead.
+type NamedDecoder interface {
+	Decoder
+	MatchName(localName string, adType byte, data []byte) bool
+}
+
+var namedRegistry []NamedDecoder
+
+// RegisterNamed adds a decoder matched on the local name as well.
+func RegisterNamed(d NamedDecoder) {
+	namedRegistry = append(namedRegistry, d)
+}
+
+// FindNamed returns the named decoder for an AD structure from a device advertising
+// localName, or nil when none matches. Being the more specific match, it goes before Find.
+func FindNamed(localName string, adType byte, data []byte) Decoder {
+	for _, d := range namedRegistry {
+		if d.MatchName(localName, adType, data) {
+			return d
+		}
+	}
+	return nil
+}
+
+func init() {
+	Register(Xiaomi{})
+	Register(ATC{})
+	Register(GoveeH5179{})
+	Register(GoveeH5075{})
+	Register(GoveeH5074{})
+	Register(Ruuvi{})
+	Register(SwitchBotMeter{})
+	Register(HeartRate{})
+	Register(BTHome{})
+	RegisterNamed(Inkbird{})
+}
@@ -0,0 +1,88 @@
+package decoders
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+type decodeCase struct {
+	name    string
+	data    string // AD structure data, without length and type
+	want    SensorData
+	wantErr bool
+}
+
+func mustHex(t *testing.T, data string) []byte {
+	t.Helper()
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		t.Fatalf("bad hex %q : %v", data, err)
+	}
+	return raw
+}
+
+func runDecodeCases(t *testing.T, adType byte, cases []decodeCase) {
+	t.Helper()
+	runNamedDecodeCases(t, "", adType, cases)
+}
+
+func runNamedDecodeCases(t *testing.T, localName string, adType byte, cases []decodeCase) { // Through FindNamed when localName is set
+	t.Helper()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := mustHex(t, tc.data)
+			decoder := Find(adType, data)
+			if len(localName) > 0 {
+				decoder = FindNamed(localName, adType, data)
+			}
+			if decoder == nil {
+				t.Fatalf("no decoder matches %s", tc.data)
+			}
+			got, err := decoder.Decode(adType, data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got err %v, want err %v", err, tc.wantErr)
+			}
+			if got.Model != tc.want.Model {
+				t.Errorf("got model %q, want %q", got.Model, tc.want.Model)
+			}
+			if tc.wantErr {
+				return
+			}
+			for _, r := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"temperature", got.TemperatureCelsius, tc.want.TemperatureCelsius},
+				{"humidity", got.HumidityPercent, tc.want.HumidityPercent},
+				{"battery", got.BatteryPercent, tc.want.BatteryPercent},
+				{"battery voltage", got.BatteryVoltage, tc.want.BatteryVoltage},
+				{"pressure", got.PressurePascal, tc.want.PressurePascal},
+				{"co2", got.CO2PPM, tc.want.CO2PPM},
+				{"voc index", got.VOCIndex, tc.want.VOCIndex},
+				{"dew point", got.DewPointCelsius, tc.want.DewPointCelsius},
+				{"illuminance", got.IlluminanceLux, tc.want.IlluminanceLux},
+				{"heart rate", got.HeartRateBPM, tc.want.HeartRateBPM},
+				{"acceleration x", got.AccelerationX, tc.want.AccelerationX},
+				{"acceleration y", got.AccelerationY, tc.want.AccelerationY},
+				{"acceleration z", got.AccelerationZ, tc.want.AccelerationZ},
+				{"tx power", got.TxPowerDBm, tc.want.TxPowerDBm},
+				{"motion", got.Motion, tc.want.Motion},
+			} {
+				if r.want == 0 {
+					r.want = Undefined // Unset in the table means not present in the frame
+				}
+				if diff := r.got - r.want; diff > 0.001 || diff < -0.001 {
+					t.Errorf("%s : got %g, want %g", r.name, r.got, r.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFindNoMatch(t *testing.T) {
+	for _, data := range []string{"2cfe000000", "1a18", "95fe5020aa01"} { // Fast Pair, too short ATC and Xiaomi
+		if d := Find(0x16, mustHex(t, data)); d != nil {
+			t.Errorf("%s : got %T, want no decoder", data, d)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package decoders
+
+// GoveeH5179 decodes the manufacturer data (company 0x8801) of the Govee H5179 WiFi
+// hygrometer, which unlike the H5075 carries separate little endian readings /
+// https://github.com/theengs/decoder/blob/development/src/devices/H5179_json.h
+type GoveeH5179 struct{}
+
+func (GoveeH5179) Match(adType byte, uuid uint16, data []byte) bool {
+	return adType == 0xFF && uuid == 0x8801 && len(data) == 11
+}
+
+func (GoveeH5179) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "GoveeH5179"
+	sensorData.TemperatureCelsius = float64(int16(uint16(data[7])<<8|uint16(data[6]))) / 100 // Signed, little endian
+	sensorData.HumidityPercent = float64(uint16(data[9])<<8|uint16(data[8])) / 100
+	sensorData.BatteryPercent = float64(data[10])
+	return sensorData, nil
+}
+
+// GoveeH5075 decodes the manufacturer data (company 0xEC88) of the Govee H5075 and H5072
+// hygrometers, temperature and humidity packed in one 24 bit big endian number, negative
+// temperatures flagged by its top bit / https://github.com/Home-Is-Where-You-Hang-Your-Hack/sensor.goveetemp_bt_hci
+type GoveeH5075 struct{}
+
+func (GoveeH5075) Match(adType byte, uuid uint16, data []byte) bool {
+	return adType == 0xFF && uuid == 0xEC88 && (len(data) == 7 || len(data) == 8) // Some firmware appends a zero
+}
+
+func (GoveeH5075) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "GVH5075"
+	packed := int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+	sign := 1.0
+	if packed&0x800000 != 0 {
+		packed &^= 0x800000
+		sign = -1
+	}
+	sensorData.TemperatureCelsius = sign * float64(packed/1000) / 10 // Whole tenths, the low three digits are the humidity
+	sensorData.HumidityPercent = float64(packed%1000) / 10
+	sensorData.BatteryPercent = float64(data[6])
+	return sensorData, nil
+}
+
+// GoveeH5074 decodes the manufacturer data (company 0xEC88) of the Govee H5074, which
+// carries separate little endian readings in hundredths like the H5179.
+type GoveeH5074 struct{}
+
+func (GoveeH5074) Match(adType byte, uuid uint16, data []byte) bool {
+	return adType == 0xFF && uuid == 0xEC88 && len(data) == 9
+}
+
+func (GoveeH5074) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "GVH5074"
+	sensorData.TemperatureCelsius = float64(int16(uint16(data[4])<<8|uint16(data[3]))) / 100 // Signed, little endian
+	sensorData.HumidityPercent = float64(uint16(data[6])<<8|uint16(data[5])) / 100
+	sensorData.BatteryPercent = float64(data[7])
+	return sensorData, nil
+}
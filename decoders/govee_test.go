@@ -0,0 +1,24 @@
+package decoders
+
+import "testing"
+
+func TestGoveeH5179(t *testing.T) {
+	runDecodeCases(t, 0xFF, []decodeCase{
+		{"H5179", "0188ec0001016608c61158", SensorData{Model: "GoveeH5179", TemperatureCelsius: 21.5, HumidityPercent: 45.5, BatteryPercent: 88}, false},
+		{"H5179 negative", "0188ec000101f3fdc61158", SensorData{Model: "GoveeH5179", TemperatureCelsius: -5.25, HumidityPercent: 45.5, BatteryPercent: 88}, false},
+	})
+	if d := Find(0xFF, mustHex(t, "0188ec0001016608c611")); d != nil { // Short
+		t.Errorf("got %T, want no decoder", d)
+	}
+}
+
+func TestGoveeH5075(t *testing.T) {
+	runDecodeCases(t, 0xFF, []decodeCase{
+		{"H5075", "88ec0003d9a364", SensorData{Model: "GVH5075", TemperatureCelsius: 25.2, HumidityPercent: 32.3, BatteryPercent: 100}, false},
+		{"H5075 trailing zero", "88ec0003d9a36400", SensorData{Model: "GVH5075", TemperatureCelsius: 25.2, HumidityPercent: 32.3, BatteryPercent: 100}, false},
+		{"H5075 negative", "88ec00800d0455", SensorData{Model: "GVH5075", TemperatureCelsius: -0.3, HumidityPercent: 33.2, BatteryPercent: 85}, false},
+		{"H5075 below -10C", "88ec0081b42c55", SensorData{Model: "GVH5075", TemperatureCelsius: -11.1, HumidityPercent: 66, BatteryPercent: 85}, false},
+		{"H5074", "88ec00dd07db1b6402", SensorData{Model: "GVH5074", TemperatureCelsius: 20.13, HumidityPercent: 71.31, BatteryPercent: 100}, false},
+		{"H5074 negative", "88ec00f3fdc8115902", SensorData{Model: "GVH5074", TemperatureCelsius: -5.25, HumidityPercent: 45.52, BatteryPercent: 89}, false},
+	})
+}
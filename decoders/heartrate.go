@@ -0,0 +1,28 @@
+package decoders
+
+import "fmt"
+
+// HeartRate decodes a Heart Rate Measurement broadcast as service data 0x180D, in the
+// layout of the GATT characteristic 0x2A37 (Bluetooth SIG Heart Rate Service 1.0, 3.1),
+// as sent by chest straps and watches with heart rate broadcasting enabled. Vendor
+// manufacturer data formats can be added as separate decoders ahead of it.
+type HeartRate struct{}
+
+func (HeartRate) Match(adType byte, uuid uint16, data []byte) bool {
+	return adType == 0x16 && uuid == 0x180D && len(data) >= 4
+}
+
+func (HeartRate) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "HeartRate"
+	flags := data[2]
+	if flags&0x01 == 0 { // Bit 0 clear, uint8 bpm
+		sensorData.HeartRateBPM = float64(data[3])
+	} else {
+		if len(data) < 5 {
+			return sensorData, fmt.Errorf("short heart rate measurement (%d bytes)", len(data))
+		}
+		sensorData.HeartRateBPM = float64(uint16(data[4])<<8 | uint16(data[3]))
+	}
+	return sensorData, nil
+}
@@ -0,0 +1,12 @@
+package decoders
+
+import "testing"
+
+func TestHeartRate(t *testing.T) {
+	runDecodeCases(t, 0x16, []decodeCase{
+		{"uint8", "0d180048", SensorData{Model: "HeartRate", HeartRateBPM: 72}, false},
+		{"uint8 with rr intervals", "0d18165a1804", SensorData{Model: "HeartRate", HeartRateBPM: 90}, false},
+		{"uint16", "0d18012c01", SensorData{Model: "HeartRate", HeartRateBPM: 300}, false},
+		{"short uint16", "0d18012c", SensorData{Model: "HeartRate"}, true},
+	})
+}
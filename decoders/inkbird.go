@@ -0,0 +1,28 @@
+package decoders
+
+import "strings"
+
+// Inkbird decodes the manufacturer data of the Inkbird IBS-TH1 and IBS-TH2, which has no
+// company id, the readings start right away. The devices are told apart by their local
+// name, sps (with humidity) or tps (temperature only) / https://github.com/custom-components/ble_monitor/blob/master/custom_components/ble_monitor/ble_parser/inkbird.py
+type Inkbird struct{}
+
+func (Inkbird) Match(adType byte, uuid uint16, data []byte) bool {
+	return false // Only by name
+}
+
+func (Inkbird) MatchName(localName string, adType byte, data []byte) bool {
+	return adType == 0xFF && len(data) == 9 && (strings.HasPrefix(localName, "sps") || strings.HasPrefix(localName, "tps"))
+}
+
+func (Inkbird) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "Inkbird"
+	sensorData.TemperatureCelsius = float64(int16(uint16(data[1])<<8|uint16(data[0]))) / 100 // Signed, little endian
+	if humidity := uint16(data[3])<<8 | uint16(data[2]); humidity != 0 {                     // 0 from the external probe, which has no humidity sensor
+		sensorData.HumidityPercent = float64(humidity) / 100
+	}
+	// data[4] is 1 while the external probe is plugged in, data[5:7] a checksum
+	sensorData.BatteryPercent = float64(data[7])
+	return sensorData, nil
+}
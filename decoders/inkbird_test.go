@@ -0,0 +1,22 @@
+package decoders
+
+import "testing"
+
+func TestInkbird(t *testing.T) {
+	runNamedDecodeCases(t, "sps", 0xFF, []decodeCase{
+		{"IBS-TH1", "3408b80d0012345508", SensorData{Model: "Inkbird", TemperatureCelsius: 21, HumidityPercent: 35.12, BatteryPercent: 85}, false},
+		{"negative", "0cfe5e1a00abcd6408", SensorData{Model: "Inkbird", TemperatureCelsius: -5, HumidityPercent: 67.5, BatteryPercent: 100}, false},
+		{"external probe", "5a0a000001abcd5008", SensorData{Model: "Inkbird", TemperatureCelsius: 26.5, BatteryPercent: 80}, false},
+	})
+	runNamedDecodeCases(t, "tps", 0xFF, []decodeCase{
+		{"IBS-TH2 temperature only", "f4010000001234460a", SensorData{Model: "Inkbird", TemperatureCelsius: 5, BatteryPercent: 70}, false},
+	})
+	for _, tc := range []struct{ name, data string }{
+		{"Phone", "3408b80d0012345508"}, // Another name
+		{"sps", "3408b80d00123455"},     // Short
+	} {
+		if d := FindNamed(tc.name, 0xFF, mustHex(t, tc.data)); d != nil {
+			t.Errorf("%s %s : got %T, want no decoder", tc.name, tc.data, d)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package decoders
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Ruuvi decodes RuuviTag manufacturer data (company 0x0499), dispatching on the data
+// format byte / https://docs.ruuvi.com/communication/bluetooth-advertisements. Format 5
+// is exported as model RuuviTag5, format 3 keeps Ruuvi so existing series carry on.
+type Ruuvi struct{}
+
+func (Ruuvi) Match(adType byte, uuid uint16, data []byte) bool {
+	return adType == 0xFF && uuid == 0x0499 && len(data) >= 3
+}
+
+func (Ruuvi) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "Ruuvi"
+	sensorData.Type = int(data[2])
+	payload := data[2:]
+	switch sensorData.Type {
+	case 3: // RAWv1 / https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-3-rawv1
+		if len(payload) < 14 {
+			return sensorData, fmt.Errorf("short Ruuvi format 3 payload (%d bytes)", len(payload))
+		}
+		sensorData.HumidityPercent = float64(payload[1]) / 2
+		temperature := float64(payload[2]&0x7F) + float64(payload[3])/100 // Sign and magnitude, not two's complement
+		if payload[2]&0x80 != 0 {
+			temperature = -temperature
+		}
+		sensorData.TemperatureCelsius = temperature
+		sensorData.PressurePascal = float64(uint16(payload[4])<<8|uint16(payload[5])) + 50000
+		sensorData.BatteryVoltage = float64(uint16(payload[12])<<8|uint16(payload[13])) / 1000
+	case 5: // RAWv2 / https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-5-rawv2
+		sensorData.Model = "RuuviTag5"
+		if len(payload) < 18 { // Up to the sequence number, the mac that follows isn't needed
+			return sensorData, fmt.Errorf("short Ruuvi format 5 payload (%d bytes)", len(payload))
+		}
+		if temperature := int16(binary.BigEndian.Uint16(payload[1:3])); temperature != -0x8000 { // Each field has a "not available" value
+			sensorData.TemperatureCelsius = float64(temperature) * 0.005
+		}
+		if humidity := binary.BigEndian.Uint16(payload[3:5]); humidity != 0xFFFF {
+			sensorData.HumidityPercent = float64(humidity) * 0.0025
+		}
+		if pressure := binary.BigEndian.Uint16(payload[5:7]); pressure != 0xFFFF {
+			sensorData.PressurePascal = float64(pressure) + 50000
+		}
+		for i, axis := range []*float64{&sensorData.AccelerationX, &sensorData.AccelerationY, &sensorData.AccelerationZ} {
+			if acceleration := int16(binary.BigEndian.Uint16(payload[7+2*i : 9+2*i])); acceleration != -0x8000 {
+				*axis = float64(acceleration) / 1000 // mg
+			}
+		}
+		power := binary.BigEndian.Uint16(payload[13:15]) // 11 bits of battery mV above 1600, 5 bits of tx power in 2dBm steps above -40
+		if battery := power >> 5; battery != 0x7FF {
+			sensorData.BatteryVoltage = float64(battery+1600) / 1000
+		}
+		if txPower := power & 0x1F; txPower != 0x1F {
+			sensorData.TxPowerDBm = float64(txPower)*2 - 40
+		}
+	default:
+		return sensorData, fmt.Errorf("unsupported Ruuvi data format %d", sensorData.Type)
+	}
+	return sensorData, nil
+}
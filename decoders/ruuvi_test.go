@@ -0,0 +1,27 @@
+package decoders
+
+import "testing"
+
+func TestRuuviFormat3(t *testing.T) {
+	runDecodeCases(t, 0xFF, []decodeCase{ // Test vectors from the format 3 specification
+		{"valid", "990403291a1ece1efc18f94202ca0b53", SensorData{Model: "Ruuvi", TemperatureCelsius: 26.3, HumidityPercent: 20.5, PressurePascal: 102766, BatteryVoltage: 2.899}, false},
+		{"negative temperature", "990403298145ce1efc18f94202ca0b53", SensorData{Model: "Ruuvi", TemperatureCelsius: -1.69, HumidityPercent: 20.5, PressurePascal: 102766, BatteryVoltage: 2.899}, false},
+		{"maximum", "990403ff7f63ffff7fff7fff7fffffff", SensorData{Model: "Ruuvi", TemperatureCelsius: 127.99, HumidityPercent: 127.5, PressurePascal: 115535, BatteryVoltage: 65.535}, false},
+		{"minimum", "99040301ff6300008001800180010001", SensorData{Model: "Ruuvi", TemperatureCelsius: -127.99, HumidityPercent: 0.5, PressurePascal: 50000, BatteryVoltage: 0.001}, false}, // 1mV, 0 reads as unset in the table
+		{"short", "990403291a1ece1e", SensorData{Model: "Ruuvi"}, true},
+		{"unknown format", "990409291a1ece1efc18f94202ca0b53", SensorData{Model: "Ruuvi"}, true},
+	})
+}
+
+func TestRuuviFormat5(t *testing.T) {
+	runDecodeCases(t, 0xFF, []decodeCase{ // Test vectors from the format 5 specification
+		{"valid", "99040512fc5394c37c0004fffc040cac364200cdcbb8334c884f", SensorData{Model: "RuuviTag5", TemperatureCelsius: 24.3, HumidityPercent: 53.49, PressurePascal: 100044,
+			AccelerationX: 0.004, AccelerationY: -0.004, AccelerationZ: 1.036, BatteryVoltage: 2.977, TxPowerDBm: 4}, false},
+		{"maximum", "9904057ffffffefffe7fff7fff7fffffdefefffecbb8334c884f", SensorData{Model: "RuuviTag5", TemperatureCelsius: 163.835, HumidityPercent: 163.835, PressurePascal: 115534,
+			AccelerationX: 32.767, AccelerationY: 32.767, AccelerationZ: 32.767, BatteryVoltage: 3.646, TxPowerDBm: 20}, false},
+		{"minimum", "9904058001000100018001800180010000000000cbb8334c884f", SensorData{Model: "RuuviTag5", TemperatureCelsius: -163.835, HumidityPercent: 0.0025, PressurePascal: 50001,
+			AccelerationX: -32.767, AccelerationY: -32.767, AccelerationZ: -32.767, BatteryVoltage: 1.6, TxPowerDBm: -40}, false}, // Humidity and pressure one step up, 0 reads as unset in the table
+		{"not available", "9904058000ffffffff800080008000ffffffffffffffffffffff", SensorData{Model: "RuuviTag5"}, false},
+		{"short", "99040512fc5394c37c0004fffc040cac3642", SensorData{Model: "RuuviTag5"}, true},
+	})
+}
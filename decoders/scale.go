@@ -0,0 +1,55 @@
+package decoders
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Raw readings are multiplied by a per model scale. A firmware variant with a different
+// scaling can be handled by overriding it (e.g. "ATC.tempScale=0.01") instead of a code change.
+
+var defaultScales = map[string]float64{
+	"ATC.tempScale":          0.1,
+	"ATC.humidityScale":      1,
+	"ATC2.tempScale":         0.1,
+	"ATC2.humidityScale":     0.01,
+	"pvvx.tempScale":         0.01,
+	"pvvx.humidityScale":     0.01,
+	"LYWSDCGQ.tempScale":     0.1,
+	"LYWSDCGQ.humidityScale": 0.1,
+}
+
+var scaleOverrides = make(map[string]float64) // Only written at startup, before any decoding
+
+// SetScale overrides the scale of a reading of a model, key is <model>.<tempScale|humidityScale>.
+func SetScale(key string, scale float64) error {
+	key = strings.TrimPrefix(key, "decoder.")
+	if _, ok := defaultScales[key]; !ok {
+		return fmt.Errorf("unknown scale %q, expected one of %s", key, strings.Join(ScaleKeys(), ", "))
+	}
+	if scale == 0 || math.IsNaN(scale) || math.IsInf(scale, 0) {
+		return fmt.Errorf("bad scale %g for %s", scale, key)
+	}
+	scaleOverrides[key] = scale
+	return nil
+}
+
+// ScaleKeys lists the scales that can be overridden.
+func ScaleKeys() []string {
+	keys := make([]string, 0, len(defaultScales))
+	for key := range defaultScales {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func divisor(model string, name string) float64 { // Dividing keeps 244 / 10 at 24.4, where 244 * 0.1 is 24.400000000000002
+	key := model + "." + name
+	if s, ok := scaleOverrides[key]; ok {
+		return 1 / s
+	}
+	return 1 / defaultScales[key]
+}
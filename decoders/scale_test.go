@@ -0,0 +1,25 @@
+package decoders
+
+import "testing"
+
+func TestSetScale(t *testing.T) {
+	defer func() { scaleOverrides = make(map[string]float64) }()
+	if err := SetScale("decoder.ATC.tempScale", 0.01); err != nil {
+		t.Fatalf("set : %v", err)
+	}
+	runDecodeCases(t, 0x16, []decodeCase{
+		{"atc1441 with a hundredths firmware", "1a18a4c13800000209893c420bb80a", SensorData{Model: "ATC", TemperatureCelsius: 24.41, HumidityPercent: 60, BatteryPercent: 66}, false},
+	})
+	for _, bad := range []struct {
+		key   string
+		scale float64
+	}{
+		{"ATC.pressureScale", 1},
+		{"Unknown.tempScale", 1},
+		{"ATC.tempScale", 0},
+	} {
+		if err := SetScale(bad.key, bad.scale); err == nil {
+			t.Errorf("set %s=%g : got no error", bad.key, bad.scale)
+		}
+	}
+}
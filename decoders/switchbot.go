@@ -0,0 +1,27 @@
+package decoders
+
+// SwitchBotMeter decodes the service data of the SwitchBot Meter and Meter Plus (WoSensorTH),
+// under the legacy 0x0D00 or the assigned 0xFD3D uuid / https://github.com/OpenWonderLabs/SwitchBotAPI-BLE/blob/latest/devicetypes/meter.md
+type SwitchBotMeter struct{}
+
+func (SwitchBotMeter) Match(adType byte, uuid uint16, data []byte) bool {
+	if adType != 0x16 || (uuid != 0x0D00 && uuid != 0xFD3D) || len(data) < 8 {
+		return false
+	}
+	deviceType := data[2] & 0x7F                  // The top bit flags encryption
+	return deviceType == 'T' || deviceType == 'i' // Meter, Meter Plus
+}
+
+func (SwitchBotMeter) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "SwitchBotMeter"
+	payload := data[2:]
+	sensorData.BatteryPercent = float64(payload[2] & 0x7F)
+	temperature := float64(payload[4]&0x7F) + float64(payload[3]&0x0F)/10 // Whole degrees and tenths, the sign apart
+	if payload[4]&0x80 == 0 {                                             // Set above zero
+		temperature = -temperature
+	}
+	sensorData.TemperatureCelsius = temperature
+	sensorData.HumidityPercent = float64(payload[5] & 0x7F) // The top bit is the display unit
+	return sensorData, nil
+}
@@ -0,0 +1,17 @@
+package decoders
+
+import "testing"
+
+func TestSwitchBotMeter(t *testing.T) {
+	runDecodeCases(t, 0x16, []decodeCase{
+		{"meter", "000d5400e4059635", SensorData{Model: "SwitchBotMeter", TemperatureCelsius: 22.5, HumidityPercent: 53, BatteryPercent: 100}, false},
+		{"meter negative", "000d5400d503054b", SensorData{Model: "SwitchBotMeter", TemperatureCelsius: -5.3, HumidityPercent: 75, BatteryPercent: 85}, false},
+		{"meter fahrenheit display", "000d5400e40596b5", SensorData{Model: "SwitchBotMeter", TemperatureCelsius: 22.5, HumidityPercent: 53, BatteryPercent: 100}, false},
+		{"meter plus", "3dfd6900e4019a28", SensorData{Model: "SwitchBotMeter", TemperatureCelsius: 26.1, HumidityPercent: 40, BatteryPercent: 100}, false},
+	})
+	for _, data := range []string{"000d5400e40596", "3dfd4800e4059635"} { // Short, and a SwitchBot Bot
+		if d := Find(0x16, mustHex(t, data)); d != nil {
+			t.Errorf("%s : got %T, want no decoder", data, d)
+		}
+	}
+}
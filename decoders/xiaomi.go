@@ -0,0 +1,74 @@
+package decoders
+
+import "fmt"
+
+// Xiaomi decodes MiBeacon service data (0xFE95) / https://github.com/tsymbaliuk/Xiaomi-Thermostat-BLE
+type Xiaomi struct{}
+
+func (Xiaomi) Match(adType byte, uuid uint16, data []byte) bool {
+	return adType == 0x16 && uuid == 0xFE95 && len(data) >= 17
+}
+
+func (Xiaomi) Decode(adType byte, data []byte) (*SensorData, error) {
+	sensorData := NewSensorData()
+	sensorData.Model = "Error"
+	sensorData.Type = int(data[13])
+	sensorData.ID = int(data[6])
+	// sensorData.Features = (int(data[3]) << 8) + int(data[2])
+	sensorData.ModelID = (int(data[5]) << 8) + int(data[4])
+	if sensorData.ModelID == 0x01aa { // LYWSDCG
+		sensorData.Model = "LYWSDCGQ"
+	} else if sensorData.ModelID == 0x055b || sensorData.ModelID == 0x2542 { // LYWSD03MMC, unencrypted when pvvx firmware advertises in its Mi-like mode
+		sensorData.Model = "LYWSD03MMC"
+	} else if sensorData.ModelID == 0x045b { // LYWSD02
+		sensorData.Model = "Unsupported"
+	} else if sensorData.ModelID == 0x07f6 { // MJYD02YL night light
+		sensorData.Model = "MJYD02YL"
+	} else if sensorData.ModelID == 0x0a8d { // RTCGQ02LM motion sensor
+		sensorData.Model = "RTCGQ02LM"
+	}
+	tempDivisor, humidityDivisor := 10.0, 10.0 // MiBeacon readings are in tenths
+	if sensorData.Model == "LYWSDCGQ" {
+		tempDivisor, humidityDivisor = divisor("LYWSDCGQ", "tempScale"), divisor("LYWSDCGQ", "humidityScale")
+	}
+	if data[2]&0x08 != 0 { // Encrypted MiBeacon (usual for MJYD02YL and RTCGQ02LM), unreadable without the bind key
+		sensorData.Type = 0
+	} else {
+		// Each object is its type, a second id byte, data_length and the data. Newer firmware
+		// appends a battery object or pads the frame, so walk the objects by their data_length.
+		for offset := 13; offset+3 <= len(data); {
+			end := offset + 3 + int(data[offset+2])
+			if end > len(data) { // Truncated object
+				break
+			}
+			decodeXiaomiObject(sensorData, data[offset], data[offset+3:end], tempDivisor, humidityDivisor)
+			offset = end
+		}
+	}
+	if (sensorData.HumidityPercent != Undefined && (sensorData.HumidityPercent < 0 || sensorData.HumidityPercent > 100)) ||
+		(sensorData.TemperatureCelsius != Undefined && (sensorData.TemperatureCelsius < -40 || sensorData.TemperatureCelsius > 85)) { // Corrupt frame, not a reading
+		return sensorData, fmt.Errorf("implausible %s reading, temperature %.1f humidity %.1f", sensorData.Model, sensorData.TemperatureCelsius, sensorData.HumidityPercent)
+	}
+	return sensorData, nil
+}
+
+func decodeXiaomiObject(sensorData *SensorData, objectType byte, value []byte, tempDivisor float64, humidityDivisor float64) {
+	switch {
+	case objectType == 0x0D && len(value) == 4: // Temperature and humidity
+		sensorData.TemperatureCelsius = float64(int16(uint16(value[1])<<8|uint16(value[0]))) / tempDivisor
+		sensorData.HumidityPercent = float64((int(value[3])<<8)+int(value[2])) / humidityDivisor
+	case objectType == 0x0A && len(value) == 1: // Battery
+		sensorData.BatteryPercent = float64(value[0])
+	case objectType == 0x06 && len(value) == 2: // Humidity
+		sensorData.HumidityPercent = float64((int(value[1])<<8)+int(value[0])) / humidityDivisor
+	case objectType == 0x04 && len(value) == 2: // Temperature
+		sensorData.TemperatureCelsius = float64(int16(uint16(value[1])<<8|uint16(value[0]))) / tempDivisor
+	case objectType == 0x07 && len(value) == 3: // Illuminance
+		sensorData.IlluminanceLux = float64((int(value[2]) << 16) + (int(value[1]) << 8) + int(value[0]))
+	case objectType == 0x0F && len(value) == 3: // Motion, with illuminance
+		sensorData.Motion = 1
+		sensorData.IlluminanceLux = float64((int(value[2]) << 16) + (int(value[1]) << 8) + int(value[0]))
+	case objectType == 0x12 && len(value) == 1 && value[0] != 0: // Motion
+		sensorData.Motion = 1
+	}
+}
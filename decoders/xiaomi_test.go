@@ -0,0 +1,24 @@
+package decoders
+
+import "testing"
+
+func TestXiaomi(t *testing.T) {
+	runDecodeCases(t, 0x16, []decodeCase{
+		{"LYWSDCGQ temperature and humidity", "95fe5020aa0101010000a8654c0d1004e4005a02", SensorData{Model: "LYWSDCGQ", TemperatureCelsius: 22.8, HumidityPercent: 60.2}, false},
+		{"MJYD02YL illuminance", "95fe5020f60701050000dc1178071003640000", SensorData{Model: "MJYD02YL", IlluminanceLux: 100}, false},
+		{"RTCGQ02LM motion", "95fe50208d0a0106000044ef540f00032c0100", SensorData{Model: "RTCGQ02LM", IlluminanceLux: 300, Motion: 1}, false},
+		{"LYWSD03MMC pvvx Mi-like temperature", "95fe50205b05010d000038c1a4041002e400", SensorData{Model: "LYWSD03MMC", TemperatureCelsius: 22.8}, false},
+		{"LYWSD03MMC pvvx Mi-like humidity", "95fe50205b05020d000038c1a40610025a02", SensorData{Model: "LYWSD03MMC", HumidityPercent: 60.2}, false},
+		{"LYWSD03MMC pvvx Mi-like temperature and humidity", "95fe50205b05030d000038c1a40d1004e4005a02", SensorData{Model: "LYWSD03MMC", TemperatureCelsius: 22.8, HumidityPercent: 60.2}, false},
+		{"LYWSD03MMC pvvx Mi-like battery", "95fe50205b05040d000038c1a40a100155", SensorData{Model: "LYWSD03MMC", BatteryPercent: 85}, false},
+		{"LYWSD03MMC 0x2542 variant", "95fe50204225050d000038c1a4041002f6ff", SensorData{Model: "LYWSD03MMC", TemperatureCelsius: -1}, false},
+		{"temperature with a trailing battery object", "95fe5020aa0101010000a8654c041002e4000a100155", SensorData{Model: "LYWSDCGQ", TemperatureCelsius: 22.8, BatteryPercent: 85}, false},
+		{"humidity with a trailing battery object", "95fe5020aa0101010000a8654c0610025a020a100155", SensorData{Model: "LYWSDCGQ", HumidityPercent: 60.2, BatteryPercent: 85}, false},
+		{"humidity padded by a byte", "95fe5020aa0101010000a8654c0610025a0200", SensorData{Model: "LYWSDCGQ", HumidityPercent: 60.2}, false},
+		{"battery after an empty padding object", "95fe5020aa0101010000a8654c0d1004e4005a020000000a100155", SensorData{Model: "LYWSDCGQ", TemperatureCelsius: 22.8, HumidityPercent: 60.2, BatteryPercent: 85}, false},
+		{"battery first", "95fe5020aa0101010000a8654c0a100155041002e400", SensorData{Model: "LYWSDCGQ", TemperatureCelsius: 22.8, BatteryPercent: 85}, false},
+		{"truncated object", "95fe5020aa0101010000a8654c0d1004e400", SensorData{Model: "LYWSDCGQ"}, false},
+		{"encrypted", "95fe5820f60701050000dc1178071003640000", SensorData{Model: "MJYD02YL"}, false},
+		{"implausible humidity", "95fe5020aa0101010000a8654c06100201ff", SensorData{Model: "LYWSDCGQ"}, true},
+	})
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/visago/ble"
+	"github.com/visago/ble/darwin"
+)
+
+func newDevice(adapterID string) (ble.Device, error) { // CoreBluetooth picks the adapter, so -adapterID is ignored
+	return darwin.NewDevice()
+}
+
+func adapterUp(adapterID string) bool { // CoreBluetooth doesn't say, report it up
+	return true
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/visago/ble"
+	"github.com/visago/ble/linux"
+)
+
+func newDevice(adapterID string) (ble.Device, error) { // Opens the HCI adapter named by -adapterID (e.g. hci1)
+	id, err := strconv.Atoi(strings.TrimPrefix(adapterID, "hci"))
+	if err != nil {
+		return nil, fmt.Errorf("bad adapter %q, expected hci<N> : %w", adapterID, err)
+	}
+	return linux.NewDeviceWithName(applicationName, ble.OptDeviceID(id))
+}
+
+const sysfsBluetooth = "/sys/class/bluetooth"
+
+// The controller can't be asked whether it's powered, the HCI user channel we scan
+// through needs it down as far as the kernel is concerned. Sysfs still tells whether
+// it's plugged in and whether rfkill blocks it.
+func adapterUp(adapterID string) bool {
+	return adapterUpIn(sysfsBluetooth, adapterID)
+}
+
+func adapterUpIn(sysfs string, adapterID string) bool {
+	if _, err := os.Stat(filepath.Join(sysfs, adapterID)); err != nil { // Unplugged
+		return false
+	}
+	states, _ := filepath.Glob(filepath.Join(sysfs, adapterID, "rfkill*", "state"))
+	for _, state := range states {
+		if value, err := os.ReadFile(state); err == nil && strings.TrimSpace(string(value)) != "1" { // 0 soft blocked, 2 hard blocked
+			return false
+		}
+	}
+	return true
+}
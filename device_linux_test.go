@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdapterUpIn(t *testing.T) {
+	sysfs := t.TempDir()
+	if adapterUpIn(sysfs, "hci0") {
+		t.Errorf("missing adapter : got up")
+	}
+	rfkill := filepath.Join(sysfs, "hci0", "rfkill3")
+	if err := os.MkdirAll(rfkill, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		state string
+		want  bool
+	}{
+		{"1\n", true},
+		{"0\n", false}, // Soft blocked
+		{"2\n", false}, // Hard blocked
+	} {
+		if err := os.WriteFile(filepath.Join(rfkill, "state"), []byte(tc.state), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := adapterUpIn(sysfs, "hci0"); got != tc.want {
+			t.Errorf("rfkill state %q : got up %v, want %v", tc.state, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The latest value of every reading of each device, merged across frames like the
+// prometheus gauges, for the consumers that don't read prometheus (OTLP, -tui, /devices).
+
+const deviceExpiryInterval = time.Minute
+
+type deviceState struct {
+	reading deviceReading
+	updated time.Time
+}
+
+var deviceMap = make(map[string]*deviceState) // MAC -> Merged readings
+var deviceMutex = &sync.RWMutex{}
+
+func recordDevice(reading *deviceReading) deviceReading { // Returns a copy of the merged readings
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	device, ok := deviceMap[reading.Mac]
+	if !ok {
+		device = &deviceState{}
+		deviceMap[reading.Mac] = device
+	}
+	mergeReading(&device.reading, reading)
+	device.updated = time.Now()
+	return device.reading
+}
+
+func listDevices() []deviceState { // Copies of the devices heard within -device-timeout, sorted by mac
+	deviceMutex.RLock()
+	defer deviceMutex.RUnlock()
+	devices := make([]deviceState, 0, len(deviceMap))
+	for _, device := range deviceMap {
+		if time.Since(device.updated) > flagDeviceTimeout { // expireDevices drops it within deviceExpiryInterval
+			continue
+		}
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].reading.Mac < devices[j].reading.Mac })
+	return devices
+}
+
+func devicesHandler(w http.ResponseWriter, r *http.Request) { // Serves /devices, every device heard within -device-timeout
+	devices := listDevices()
+	readings := make([]deviceReading, 0, len(devices)) // [] rather than null while nothing was heard
+	for _, device := range devices {
+		readings = append(readings, device.reading)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readings)
+}
+
+func mergeReading(dst *deviceReading, src *deviceReading) { // Frames often carry a subset of the readings (e.g. LYWSDCGQ), keep the rest
+	dst.Mac, dst.Name, dst.RawName, dst.Model, dst.RSSI, dst.LastSeen = src.Mac, src.Name, src.RawName, src.Model, src.RSSI, src.LastSeen
+	if len(src.Color) > 0 {
+		dst.Color = src.Color
+	}
+	if len(src.LocalName) > 0 {
+		dst.LocalName = src.LocalName
+	}
+	dstFields, srcFields := readingFields(dst), readingFields(src)
+	for i := range srcFields {
+		if *srcFields[i] != nil {
+			*dstFields[i] = *srcFields[i]
+		}
+	}
+}
+
+func readingFields(r *deviceReading) []**float64 { // Every optional reading, in a fixed order
+	return []**float64{
+		&r.TemperatureCelsius,
+		&r.HumidityPercent,
+		&r.BatteryPercent,
+		&r.CO2PPM,
+		&r.PressurePascal,
+		&r.VOCIndex,
+		&r.SpecificGravity,
+		&r.IlluminanceLux,
+		&r.DewPointCelsius,
+		&r.HeartRateBPM,
+		&r.AccelerationXG,
+		&r.AccelerationYG,
+		&r.AccelerationZG,
+		&r.TxPowerDBm,
+		&r.Motion,
+	}
+}
+
+var publishedMap = make(map[string]*deviceReading) // MAC -> Merged readings as last propagated with -only-on-change
+var publishedMutex = &sync.RWMutex{}
+
+func readingChanged(reading *deviceReading, epsilon float64) bool { // Whether any value moved more than epsilon since it was last propagated
+	publishedMutex.Lock()
+	defer publishedMutex.Unlock()
+	published, ok := publishedMap[reading.Mac]
+	if !ok {
+		published = &deviceReading{}
+		publishedMap[reading.Mac] = published
+	}
+	changed := !ok || reading.Motion != nil || reading.Model != published.Model || (len(reading.Color) > 0 && reading.Color != published.Color) // Every motion event counts
+	publishedFields, newFields := readingFields(published), readingFields(reading)
+	for i := range newFields {
+		if *newFields[i] == nil {
+			continue
+		}
+		if *publishedFields[i] == nil || math.Abs(**newFields[i]-**publishedFields[i]) > epsilon {
+			changed = true
+		}
+	}
+	if changed {
+		mergeReading(published, reading)
+	}
+	return changed
+}
+
+type upState struct {
+	labels prometheus.Labels
+	last   time.Time
+	down   bool
+}
+
+var upMap = make(map[string]*upState) // MAC -> btle_exporter_device_up series
+var upMutex = &sync.RWMutex{}
+
+func markDeviceUp(mac string, labels prometheus.Labels) {
+	upMutex.Lock()
+	defer upMutex.Unlock()
+	if up, ok := upMap[mac]; ok && !sameLabels(up.labels, labels) { // Renamed, don't leave the old series behind
+		metricsDeviceUpGauge.Delete(up.labels)
+		metricsDeviceAdvertisementLastSeenGauge.Delete(up.labels)
+		deleteDeviceReadings(up.labels)
+	}
+	upMap[mac] = &upState{labels: labels, last: time.Now()}
+	metricsDeviceUpGauge.Set(labels, 1)
+}
+
+func sameLabels(a prometheus.Labels, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+var metricsDeviceTimeoutGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "btle_exporter_device_timeout_seconds",
+	Help: "The configured -device-timeout",
+})
+
+var metricsOldestDeviceAgeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "btle_exporter_oldest_device_age_seconds",
+	Help: "Time since the least recently heard device still within -device-timeout was heard",
+})
+
+func oldestDeviceAge(now time.Time) time.Duration { // Among the devices heard within -device-timeout
+	var oldest time.Duration
+	timeOutMutex.RLock()
+	defer timeOutMutex.RUnlock()
+	for _, last := range timeOutMap {
+		age := now.Sub(time.Unix(last, 0))
+		if age <= flagDeviceTimeout && age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+var expiringDeviceGauges = []*deviceGaugeVec{ // Dropped once a device times out, a dead sensor's last reading would otherwise graph flat forever
+	metricsDeviceTemperatureGauge,
+	metricsDeviceHumidityGauge,
+	metricsDeviceBatteryGauge,
+	metricsDeviceBatteryDrainGauge,
+	metricsDeviceCO2Gauge,
+	metricsDevicePressureGauge,
+	metricsDeviceVOCGauge,
+	metricsDeviceIlluminanceGauge,
+	metricsDeviceDewPointGauge,
+	metricsDeviceHeartRateGauge,
+	metricsDeviceTxPowerGauge,
+	metricsDeviceMotionGauge,
+	metricsDeviceSignalGauge,
+}
+
+func deleteDeviceReadings(labels prometheus.Labels) { // With the labels the readings were set with, as kept in upMap
+	for _, gauge := range expiringDeviceGauges {
+		gauge.Delete(labels)
+	}
+	withLabel := func(name string, value string) prometheus.Labels {
+		extended := prometheus.Labels{name: value}
+		for k, v := range labels {
+			extended[k] = v
+		}
+		return extended
+	}
+	for _, axis := range []string{"x", "y", "z"} {
+		metricsDeviceAccelerationGauge.Delete(withLabel("axis", axis))
+	}
+	for _, color := range append([]string{""}, tiltColors...) { // Only Tilts report gravity
+		metricsDeviceGravityGauge.Delete(withLabel("color", color))
+	}
+}
+
+func pruneTimeOutMap(now time.Time) { // Forgets the devices not heard within -device-timeout, every passing phone would pile up otherwise
+	timeOutMutex.Lock()
+	defer timeOutMutex.Unlock()
+	for mac, last := range timeOutMap {
+		if now.Sub(time.Unix(last, 0)) > flagDeviceTimeout {
+			delete(timeOutMap, mac)
+		}
+	}
+}
+
+func pruneDeviceMap(now time.Time) { // Forgets the merged readings of the devices not heard within -device-timeout
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	for mac, device := range deviceMap {
+		if now.Sub(device.updated) <= flagDeviceTimeout {
+			continue
+		}
+		delete(deviceMap, mac)
+		publishedMutex.Lock()
+		delete(publishedMap, mac) // Propagate the first reading after it comes back
+		publishedMutex.Unlock()
+	}
+}
+
+func expireDevices(now time.Time) { // After -device-timeout drops the readings and flips btle_exporter_device_up to 0, which is dropped after -device-up-grace
+	metricsOldestDeviceAgeGauge.Set(oldestDeviceAge(now).Seconds())
+	pruneTimeOutMap(now)
+	pruneDeviceMap(now)
+	expireAdapterSeen(now)
+	expireRSSI(now)
+	expireLocalNames(now)
+	expireAverages(now)
+	expirePayloadHashes(now)
+	upMutex.Lock()
+	defer upMutex.Unlock()
+	for mac, up := range upMap {
+		age := now.Sub(up.last)
+		if age > flagDeviceTimeout+flagDeviceUpGrace {
+			metricsDeviceUpGauge.Delete(up.labels)
+			metricsDeviceAdvertisementLastSeenGauge.Delete(up.labels)
+			delete(upMap, mac)
+		} else if age > flagDeviceTimeout && !up.down {
+			deleteDeviceReadings(up.labels)
+			metricsDeviceUpGauge.Set(up.labels, 0)
+			up.down = true
+		}
+	}
+}
+
+func expireDevicesPeriodically() {
+	metricsDeviceTimeoutGauge.Set(flagDeviceTimeout.Seconds())
+	ticker := time.NewTicker(deviceExpiryInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expireDevices(now)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// -external-decoder hands the advertisements no built-in decoder understands to a long
+// running command, to prototype decoders in any language. It gets a "<mac> <rssi> <hex>"
+// line on stdin per advertisement and answers each with one json line in the -json-stdout
+// format ({"model":"...","temperature_celsius":21.5}), or an empty line when it can't
+// decode it either. A command that errors or doesn't answer within -external-decoder-timeout
+// is killed, the advertisement stays Unknown, and the command is restarted later.
+
+const externalDecoderRetryInterval = 10 * time.Second // Between restarts, so a broken command isn't spawned per advertisement
+
+type externalDecoderProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines chan []byte
+	done  chan struct{}
+}
+
+var externalDecoder *externalDecoderProcess
+var externalDecoderFailed time.Time // When it last had to be killed
+var externalDecoderMutex = &sync.Mutex{}
+
+var metricsExternalDecoderErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "btle_exporter_external_decoder_error_count",
+	Help: "The total number of advertisements the -external-decoder failed on, by reason (start, exit, timeout or bad_answer)",
+}, []string{"reason"})
+
+func startExternalDecoder() (*externalDecoderProcess, error) {
+	cmd := exec.Command("sh", "-c", flagExternalDecoder)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &externalDecoderProcess{cmd: cmd, stdin: stdin, lines: make(chan []byte, 1), done: make(chan struct{})}
+	go func() {
+		defer close(p.lines)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			select {
+			case p.lines <- append([]byte(nil), scanner.Bytes()...):
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	logInfo("Started -external-decoder %q (pid %d)", flagExternalDecoder, cmd.Process.Pid)
+	return p, nil
+}
+
+func (p *externalDecoderProcess) stop() {
+	close(p.done)
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	go p.cmd.Wait() // Reap it
+}
+
+func externalDecoderFailure(reason string, err error) { // Must hold externalDecoderMutex
+	metricsExternalDecoderErrorCount.With(prometheus.Labels{"reason": reason}).Inc()
+	logWarn("-external-decoder failed (%s) - %v, restarting it in %s", reason, err, externalDecoderRetryInterval)
+	if externalDecoder != nil {
+		externalDecoder.stop()
+		externalDecoder = nil
+	}
+	externalDecoderFailed = time.Now()
+}
+
+func externalDecode(mac string, rssi int, data []byte) *SensorData { // nil when the command couldn't decode it either
+	externalDecoderMutex.Lock()
+	defer externalDecoderMutex.Unlock()
+	if externalDecoder == nil {
+		if time.Since(externalDecoderFailed) < externalDecoderRetryInterval {
+			return nil
+		}
+		p, err := startExternalDecoder()
+		if err != nil {
+			externalDecoderFailure("start", err)
+			return nil
+		}
+		externalDecoder = p
+	}
+	if _, err := fmt.Fprintf(externalDecoder.stdin, "%s %d %s\n", mac, rssi, hex.EncodeToString(data)); err != nil {
+		externalDecoderFailure("exit", err)
+		return nil
+	}
+	timeout := time.NewTimer(flagExternalDecoderTimeout)
+	defer timeout.Stop()
+	select {
+	case line, ok := <-externalDecoder.lines:
+		if !ok {
+			externalDecoderFailure("exit", errors.New("exited"))
+			return nil
+		}
+		sensorData, err := parseExternalReading(line)
+		if err != nil { // The command is still in step, no need to restart it
+			metricsExternalDecoderErrorCount.With(prometheus.Labels{"reason": "bad_answer"}).Inc()
+			logWarn("-external-decoder answered %q for %s - %v", line, mac, err)
+		}
+		return sensorData
+	case <-timeout.C:
+		externalDecoderFailure("timeout", fmt.Errorf("no answer for %s within %s", mac, flagExternalDecoderTimeout))
+		return nil
+	}
+}
+
+func parseExternalReading(line []byte) (*SensorData, error) { // nil without an error for an empty answer
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil, nil
+	}
+	var reading deviceReading
+	if err := json.Unmarshal(line, &reading); err != nil {
+		return nil, err
+	}
+	if len(reading.Model) == 0 {
+		return nil, errors.New("no model")
+	}
+	sensorData := newSensorData()
+	sensorData.Model = reading.Model
+	sensorData.Color = reading.Color
+	for _, field := range []struct {
+		value *float64
+		dst   *float64
+	}{
+		{reading.TemperatureCelsius, &sensorData.TemperatureCelsius},
+		{reading.HumidityPercent, &sensorData.HumidityPercent},
+		{reading.BatteryPercent, &sensorData.BatteryPercent},
+		{reading.CO2PPM, &sensorData.CO2PPM},
+		{reading.PressurePascal, &sensorData.PressurePascal},
+		{reading.VOCIndex, &sensorData.VOCIndex},
+		{reading.SpecificGravity, &sensorData.SpecificGravity},
+		{reading.IlluminanceLux, &sensorData.IlluminanceLux},
+		{reading.DewPointCelsius, &sensorData.DewPointCelsius},
+		{reading.HeartRateBPM, &sensorData.HeartRateBPM},
+		{reading.AccelerationXG, &sensorData.AccelerationX},
+		{reading.AccelerationYG, &sensorData.AccelerationY},
+		{reading.AccelerationZG, &sensorData.AccelerationZ},
+		{reading.TxPowerDBm, &sensorData.TxPowerDBm},
+		{reading.Motion, &sensorData.Motion},
+	} {
+		if field.value != nil {
+			*field.dst = *field.value
+		}
+	}
+	return sensorData, nil
+}
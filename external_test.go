@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExternalDecode(t *testing.T) {
+	defer func(command string, timeout time.Duration) {
+		flagExternalDecoder, flagExternalDecoderTimeout = command, timeout
+	}(flagExternalDecoder, flagExternalDecoderTimeout)
+	defer func() {
+		externalDecoderMutex.Lock()
+		if externalDecoder != nil {
+			externalDecoder.stop()
+			externalDecoder = nil
+		}
+		externalDecoderFailed = time.Time{}
+		externalDecoderMutex.Unlock()
+	}()
+	flagExternalDecoderTimeout = 2 * time.Second
+	flagExternalDecoder = `while read mac rssi data; do
+		case $data in
+		0201*) echo '{"model":"Custom","temperature_celsius":21.5,"battery_percent":90}' ;;
+		ff*) echo 'not json' ;;
+		*) echo ;;
+		esac
+	done`
+	sensorData := externalDecode("aa:bb:cc:dd:ee:65", -60, []byte{0x02, 0x01, 0x06})
+	if sensorData == nil || sensorData.Model != "Custom" || sensorData.TemperatureCelsius != 21.5 || sensorData.BatteryPercent != 90 || sensorData.HumidityPercent != undefined {
+		t.Fatalf("got %+v", sensorData)
+	}
+	if sensorData := externalDecode("aa:bb:cc:dd:ee:65", -60, []byte{0x03}); sensorData != nil {
+		t.Errorf("empty answer : got %+v, want nil", sensorData)
+	}
+	if sensorData := externalDecode("aa:bb:cc:dd:ee:65", -60, []byte{0xff}); sensorData != nil {
+		t.Errorf("bad answer : got %+v, want nil", sensorData)
+	}
+	if sensorData := externalDecode("aa:bb:cc:dd:ee:65", -60, []byte{0x02, 0x01}); sensorData == nil { // Still running after a bad answer
+		t.Errorf("after a bad answer : got nil")
+	}
+
+	externalDecoderMutex.Lock()
+	externalDecoder.stop()
+	externalDecoder = nil
+	externalDecoderMutex.Unlock()
+	flagExternalDecoder, flagExternalDecoderTimeout = "cat >/dev/null", 50*time.Millisecond // Never answers
+	start := time.Now()
+	if sensorData := externalDecode("aa:bb:cc:dd:ee:65", -60, []byte{0x02, 0x01, 0x06}); sensorData != nil {
+		t.Errorf("timeout : got %+v, want nil", sensorData)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout took %s", elapsed)
+	}
+	externalDecoderMutex.Lock()
+	killed := externalDecoder == nil && !externalDecoderFailed.IsZero()
+	externalDecoderMutex.Unlock()
+	if !killed {
+		t.Errorf("command still running after a timeout")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// -fifo writes every reading as a json line to a named pipe, for local scripts. The
+// pipe is opened non-blocking, and readings are dropped while no reader is attached
+// or the reader falls behind, so the scan never waits on it.
+
+var fifoFile *os.File
+var fifoMutex = &sync.Mutex{}
+
+var metricsFIFODroppedCount = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "btle_exporter_fifo_dropped_count",
+	Help: "The total number of readings dropped because no -fifo reader was attached or it fell behind",
+})
+
+func createFIFO() error {
+	info, err := os.Stat(flagFIFO)
+	if errors.Is(err, os.ErrNotExist) {
+		return syscall.Mkfifo(flagFIFO, 0644)
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return errors.New(flagFIFO + " exists and is not a named pipe")
+	}
+	return nil
+}
+
+func writeFIFO(reading *deviceReading) {
+	line, err := json.Marshal(reading)
+	if err != nil {
+		logWarn("Failed to encode -fifo reading for %s - %v", reading.Mac, err)
+		return
+	}
+	line = append(line, '\n') // Below PIPE_BUF, so lines never interleave
+	fifoMutex.Lock()
+	defer fifoMutex.Unlock()
+	if fifoFile == nil {
+		f, err := os.OpenFile(flagFIFO, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err != nil { // ENXIO while nobody has the pipe open for reading
+			metricsFIFODroppedCount.Inc()
+			return
+		}
+		fifoFile = f
+	}
+	conn, err := fifoFile.SyscallConn()
+	if err == nil {
+		conn.Write(func(fd uintptr) bool { // One attempt, os.File.Write would wait for a full pipe to drain
+			_, err = syscall.Write(int(fd), line)
+			return true
+		})
+	}
+	if err != nil {
+		metricsFIFODroppedCount.Inc()
+		if !errors.Is(err, syscall.EAGAIN) { // EPIPE, the reader went away, reopen once there's a new one
+			fifoFile.Close()
+			fifoFile = nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWriteFIFO(t *testing.T) {
+	defer func(path string) { flagFIFO = path }(flagFIFO)
+	flagFIFO = filepath.Join(t.TempDir(), "readings")
+	if err := createFIFO(); err != nil {
+		t.Fatalf("create : %v", err)
+	}
+	if err := createFIFO(); err != nil { // Reuses the existing pipe
+		t.Fatalf("create again : %v", err)
+	}
+	reading := &deviceReading{Mac: "a4:c1:38:00:00:01", Model: "ATC"}
+	dropped := testutil.ToFloat64(metricsFIFODroppedCount)
+	writeFIFO(reading) // Nobody reading, must not block
+	if got := testutil.ToFloat64(metricsFIFODroppedCount) - dropped; got != 1 {
+		t.Errorf("dropped %g readings without a reader, want 1", got)
+	}
+
+	reader, err := os.OpenFile(flagFIFO, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("open reader : %v", err)
+	}
+	writeFIFO(reading)
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil || !strings.Contains(line, `"a4:c1:38:00:00:01"`) {
+		t.Errorf("read %q, %v", line, err)
+	}
+
+	reader.Close() // The next write hits EPIPE and drops, the one after reopens and finds no reader again
+	dropped = testutil.ToFloat64(metricsFIFODroppedCount)
+	writeFIFO(reading)
+	writeFIFO(reading)
+	if got := testutil.ToFloat64(metricsFIFODroppedCount) - dropped; got != 2 {
+		t.Errorf("dropped %g readings after the reader left, want 2", got)
+	}
+	if fifoFile != nil {
+		t.Errorf("pipe still open after the reader left")
+	}
+}
+
+func TestCreateFIFORejectsRegularFile(t *testing.T) {
+	defer func(path string) { flagFIFO = path }(flagFIFO)
+	flagFIFO = filepath.Join(t.TempDir(), "readings")
+	if err := os.WriteFile(flagFIFO, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := createFIFO(); err == nil {
+		t.Errorf("got no error for a regular file")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// -min-rssi, -mac-allow, -mac-deny and -min-payload-length drop advertisements before they are decoded. The
+// most recent drops are kept with their reason and served on /filtered, so the filters
+// can be tuned without reading logs.
+
+const filteredRingSize = 256 // Drops kept for /filtered
+
+const (
+	filterRSSIBelowMin = "rssi_below_min"
+	filterMacDenied    = "mac_denied"
+	filterNotAllowed   = "not_allowed"
+	filterPayloadShort = "payload_too_short"
+)
+
+var macAllowSet = make(map[string]bool) // From -mac-allow, empty allows every mac
+var macDenySet = make(map[string]bool)  // From -mac-deny
+
+type filteredAdvertisement struct {
+	Mac    string    `json:"mac"`
+	RSSI   int       `json:"rssi"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+var filteredRing = make([]filteredAdvertisement, filteredRingSize)
+var filteredNext int  // Where the next drop goes
+var filteredFull bool // Whether the ring has wrapped around
+var filteredMutex = &sync.RWMutex{}
+
+var metricsAdvertisementFilteredCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "btle_exporter_advertisement_filtered_count",
+	Help: "The total number of advertisements dropped by -min-rssi, -mac-allow, -mac-deny or -min-payload-length, by reason",
+}, []string{"reason"})
+
+func parseMacSet(macs string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, mac := range strings.Split(macs, ",") {
+		if mac = strings.TrimSpace(mac); len(mac) == 0 {
+			continue
+		}
+		if _, err := net.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("bad mac %q", mac)
+		}
+		set[strings.ToLower(mac)] = true
+	}
+	return set, nil
+}
+
+func filterReason(mac string, rssi int, payloadLength int) string { // Empty when the advertisement passes every filter
+	if macDenySet[mac] {
+		return filterMacDenied
+	}
+	if len(macAllowSet) > 0 && !macAllowSet[mac] {
+		return filterNotAllowed
+	}
+	if flagMinRSSI != 0 && rssi < flagMinRSSI {
+		return filterRSSIBelowMin
+	}
+	if payloadLength < flagMinPayloadLength {
+		return filterPayloadShort
+	}
+	return ""
+}
+
+func recordFiltered(mac string, rssi int, reason string, now time.Time) {
+	metricsAdvertisementFilteredCount.With(prometheus.Labels{"reason": reason}).Inc()
+	filteredMutex.Lock()
+	defer filteredMutex.Unlock()
+	filteredRing[filteredNext] = filteredAdvertisement{Mac: mac, RSSI: rssi, Reason: reason, Time: now}
+	filteredNext = (filteredNext + 1) % len(filteredRing)
+	if filteredNext == 0 {
+		filteredFull = true
+	}
+}
+
+func listFiltered() []filteredAdvertisement { // Newest first
+	filteredMutex.RLock()
+	defer filteredMutex.RUnlock()
+	count := filteredNext
+	if filteredFull {
+		count = len(filteredRing)
+	}
+	list := make([]filteredAdvertisement, 0, count)
+	for i := 1; i <= count; i++ {
+		list = append(list, filteredRing[(filteredNext-i+len(filteredRing))%len(filteredRing)])
+	}
+	return list
+}
+
+func filteredHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listFiltered())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilterReason(t *testing.T) {
+	defer func(allow, deny map[string]bool, minRSSI, minLength int) {
+		macAllowSet, macDenySet, flagMinRSSI, flagMinPayloadLength = allow, deny, minRSSI, minLength
+	}(macAllowSet, macDenySet, flagMinRSSI, flagMinPayloadLength)
+	var err error
+	if macAllowSet, err = parseMacSet("A4:C1:38:00:00:01, a4:c1:38:00:00:02"); err != nil {
+		t.Fatalf("allow : %v", err)
+	}
+	if macDenySet, err = parseMacSet("a4:c1:38:00:00:02"); err != nil {
+		t.Fatalf("deny : %v", err)
+	}
+	flagMinRSSI, flagMinPayloadLength = -90, 8
+	for _, tc := range []struct {
+		mac    string
+		rssi   int
+		length int
+		want   string
+	}{
+		{"a4:c1:38:00:00:01", -70, 20, ""},
+		{"a4:c1:38:00:00:01", -95, 20, filterRSSIBelowMin},
+		{"a4:c1:38:00:00:01", -70, 3, filterPayloadShort},
+		{"a4:c1:38:00:00:01", -70, 8, ""},
+		{"a4:c1:38:00:00:02", -70, 20, filterMacDenied}, // Deny wins over allow
+		{"a4:c1:38:00:00:03", -70, 20, filterNotAllowed},
+	} {
+		if got := filterReason(tc.mac, tc.rssi, tc.length); got != tc.want {
+			t.Errorf("%s %d %d : got %q, want %q", tc.mac, tc.rssi, tc.length, got, tc.want)
+		}
+	}
+	if _, err := parseMacSet("a4:c1:38"); err == nil {
+		t.Errorf("short mac accepted")
+	}
+}
+
+func TestListFiltered(t *testing.T) {
+	defer func(ring []filteredAdvertisement, next int, full bool) {
+		filteredRing, filteredNext, filteredFull = ring, next, full
+	}(filteredRing, filteredNext, filteredFull)
+	filteredRing, filteredNext, filteredFull = make([]filteredAdvertisement, 3), 0, false
+	now := time.Now()
+	recordFiltered("a4:c1:38:00:00:01", -95, filterRSSIBelowMin, now)
+	if got := listFiltered(); len(got) != 1 || got[0].Mac != "a4:c1:38:00:00:01" || got[0].Reason != filterRSSIBelowMin {
+		t.Fatalf("got %+v", got)
+	}
+	for _, mac := range []string{"a4:c1:38:00:00:02", "a4:c1:38:00:00:03", "a4:c1:38:00:00:04"} {
+		recordFiltered(mac, -70, filterNotAllowed, now)
+	}
+	got := listFiltered() // Bounded, newest first
+	if len(got) != 3 || got[0].Mac != "a4:c1:38:00:00:04" || got[2].Mac != "a4:c1:38:00:00:02" {
+		t.Errorf("got %+v", got)
+	}
+}
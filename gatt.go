@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/visago/ble"
+)
+
+// Some sensors (original Mi Flora, stock LYWSD03MMC, TI SensorTag) never broadcast their readings,
+// so -gatt-poll connects to them every -gatt-poll-interval and reads them instead.
+
+const gattConnectTimeout = 30 * time.Second
+const gattMaxBackoff = time.Hour
+const sensorTagSettleTime = 1500 * time.Millisecond // The sensors are off until enabled, and take a period to produce a first sample
+
+var (
+	// Mi Flora (HHCCJCY01) - https://github.com/vrachieru/xiaomi-flower-care-api
+	floraService           = ble.UUID16(0x1204)
+	floraModeCharacter     = ble.UUID16(0x1a00) // Write 0xa01f to switch to realtime readings
+	floraDataCharacter     = ble.UUID16(0x1a01) // Temperature, light, moisture and conductivity
+	floraFirmwareCharacter = ble.UUID16(0x1a02) // Battery, then firmware version
+	// LYWSD03MMC stock firmware - https://github.com/JsBergbau/MiTemperature2
+	lywsd03Service       = ble.MustParse("ebe0ccb07a0a4b0c8a1a6ff2997da3a6")
+	lywsd03DataCharacter = ble.MustParse("ebe0ccc17a0a4b0c8a1a6ff2997da3a6") // Temperature, humidity and battery voltage
+	// TI CC2650 SensorTag stock firmware, each sensor has a data and a config (write 0x01 to enable) characteristic
+	// https://web.archive.org/web/2020/http://processors.wiki.ti.com/index.php/CC2650_SensorTag_User's_Guide
+	sensorTagHumidityService = ble.MustParse("f000aa2004514000b000000000000000")
+	sensorTagHumidityData    = ble.MustParse("f000aa2104514000b000000000000000") // HDC1000 temperature and humidity
+	sensorTagHumidityConfig  = ble.MustParse("f000aa2204514000b000000000000000")
+	sensorTagBarometerData   = ble.MustParse("f000aa4104514000b000000000000000") // BMP280 temperature and pressure
+	sensorTagBarometerConfig = ble.MustParse("f000aa4204514000b000000000000000")
+	sensorTagOpticalData     = ble.MustParse("f000aa7104514000b000000000000000") // OPT3001 light
+	sensorTagOpticalConfig   = ble.MustParse("f000aa7204514000b000000000000000")
+)
+
+var metricsGATTPollFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "btle_exporter_gatt_poll_failure_count",
+	Help: "The total number of failed GATT connect-and-read polls",
+}, []string{"mac"},
+)
+
+func gattPollMACs() []string {
+	var macs []string
+	for _, mac := range strings.Split(flagGATTPoll, ",") {
+		if mac = strings.ToLower(strings.TrimSpace(mac)); len(mac) > 0 { // .Addr always returns lower case
+			macs = append(macs, mac)
+		}
+	}
+	return macs
+}
+
+func gattPoll(mac string) { // Polls one device forever, backing off while it can't be reached
+	wait := flagGATTPollInterval
+	for {
+		start := time.Now()
+		if err := gattPollOnce(mac); err != nil {
+			metricsGATTPollFailureCount.With(prometheus.Labels{"mac": mac}).Inc()
+			wait *= 2
+			if wait > gattMaxBackoff {
+				wait = gattMaxBackoff
+			}
+			logWarn("GATT poll of %s failed after %s - %v, retrying in %s", mac, time.Since(start).Round(time.Millisecond), err, wait)
+		} else {
+			wait = flagGATTPollInterval
+		}
+		time.Sleep(wait)
+	}
+}
+
+func gattPollOnce(mac string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gattConnectTimeout)
+	defer cancel()
+	client, err := ble.Dial(ctx, ble.NewAddr(mac))
+	if err != nil {
+		return fmt.Errorf("connect : %w", err)
+	}
+	defer client.CancelConnection()
+	profile, err := client.DiscoverProfile(true)
+	if err != nil {
+		return fmt.Errorf("discover profile : %w", err)
+	}
+	var sensorData *SensorData
+	if profile.FindService(ble.NewService(floraService)) != nil {
+		sensorData, err = gattReadFlora(client, profile)
+	} else if profile.FindService(ble.NewService(lywsd03Service)) != nil {
+		sensorData, err = gattReadLYWSD03(client, profile)
+	} else if profile.FindService(ble.NewService(sensorTagHumidityService)) != nil {
+		sensorData, err = gattReadSensorTag(client, profile)
+	} else {
+		return fmt.Errorf("no known sensor service")
+	}
+	if err != nil {
+		return err
+	}
+	applyCalibration(mac, sensorData)
+	rejectImplausibleReadings(sensorData)
+	exportReading(mac, getMacName(mac), client.ReadRSSI(), sensorData)
+	return nil
+}
+
+func gattReadCharacteristic(client ble.Client, profile *ble.Profile, uuid ble.UUID) ([]byte, error) {
+	c := profile.FindCharacteristic(ble.NewCharacteristic(uuid))
+	if c == nil {
+		return nil, fmt.Errorf("characteristic %s not found", uuid)
+	}
+	return client.ReadCharacteristic(c)
+}
+
+func gattReadFlora(client ble.Client, profile *ble.Profile) (*SensorData, error) {
+	mode := profile.FindCharacteristic(ble.NewCharacteristic(floraModeCharacter))
+	if mode == nil {
+		return nil, fmt.Errorf("characteristic %s not found", floraModeCharacter)
+	}
+	if err := client.WriteCharacteristic(mode, []byte{0xa0, 0x1f}, false); err != nil {
+		return nil, fmt.Errorf("enable realtime readings : %w", err)
+	}
+	data, err := gattReadCharacteristic(client, profile, floraDataCharacter)
+	if err != nil {
+		return nil, err
+	}
+	firmware, _ := gattReadCharacteristic(client, profile, floraFirmwareCharacter) // Battery is optional
+	return decodeFloraReading(data, firmware)
+}
+
+func decodeFloraReading(data []byte, firmware []byte) (*SensorData, error) {
+	if len(data) < 10 {
+		return nil, fmt.Errorf("short Mi Flora reading (%d bytes)", len(data))
+	}
+	sensorData := newSensorData()
+	sensorData.Model = "HHCCJCY01"
+	sensorData.TemperatureCelsius = float64(int16(binary.LittleEndian.Uint16(data[0:2]))) / 10
+	sensorData.IlluminanceLux = float64(binary.LittleEndian.Uint32(data[3:7]))
+	if len(firmware) > 0 {
+		sensorData.BatteryPercent = float64(firmware[0])
+	}
+	return sensorData, nil
+}
+
+func gattReadLYWSD03(client ble.Client, profile *ble.Profile) (*SensorData, error) {
+	data, err := gattReadCharacteristic(client, profile, lywsd03DataCharacter)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLYWSD03Reading(data)
+}
+
+func decodeLYWSD03Reading(data []byte) (*SensorData, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("short LYWSD03MMC reading (%d bytes)", len(data))
+	}
+	sensorData := newSensorData()
+	sensorData.Model = "LYWSD03MMC"
+	sensorData.TemperatureCelsius = float64(int16(binary.LittleEndian.Uint16(data[0:2]))) / 100
+	sensorData.HumidityPercent = float64(data[2])
+	sensorData.BatteryVoltage = float64(binary.LittleEndian.Uint16(data[3:5])) / 1000
+	sensorData.FillBatteryPercent()
+	return sensorData, nil
+}
+
+func gattReadSensorTag(client ble.Client, profile *ble.Profile) (*SensorData, error) {
+	for _, uuid := range []ble.UUID{sensorTagHumidityConfig, sensorTagBarometerConfig, sensorTagOpticalConfig} {
+		c := profile.FindCharacteristic(ble.NewCharacteristic(uuid))
+		if c == nil {
+			continue // Barometer and light are optional, the humidity read below fails without its sensor
+		}
+		if err := client.WriteCharacteristic(c, []byte{0x01}, false); err != nil {
+			return nil, fmt.Errorf("enable sensor %s : %w", uuid, err)
+		}
+	}
+	time.Sleep(sensorTagSettleTime)
+	humidity, err := gattReadCharacteristic(client, profile, sensorTagHumidityData)
+	if err != nil {
+		return nil, err
+	}
+	barometer, _ := gattReadCharacteristic(client, profile, sensorTagBarometerData)
+	optical, _ := gattReadCharacteristic(client, profile, sensorTagOpticalData)
+	return decodeSensorTagReading(humidity, barometer, optical)
+}
+
+func decodeSensorTagReading(humidity []byte, barometer []byte, optical []byte) (*SensorData, error) {
+	if len(humidity) < 4 {
+		return nil, fmt.Errorf("short SensorTag humidity reading (%d bytes)", len(humidity))
+	}
+	sensorData := newSensorData()
+	sensorData.Model = "SensorTag"
+	sensorData.TemperatureCelsius = float64(binary.LittleEndian.Uint16(humidity[0:2]))/65536*165 - 40
+	sensorData.HumidityPercent = float64(binary.LittleEndian.Uint16(humidity[2:4])&^0x0003) / 65536 * 100 // The low 2 bits are status
+	if len(barometer) >= 6 {
+		sensorData.PressurePascal = float64(uint32(barometer[3]) | uint32(barometer[4])<<8 | uint32(barometer[5])<<16) // Hundredths of a hPa, so Pa
+	}
+	if len(optical) >= 2 {
+		raw := binary.LittleEndian.Uint16(optical[0:2])
+		sensorData.IlluminanceLux = float64(raw&0x0FFF) * 0.01 * float64(uint32(1)<<(raw>>12)) // 12 bit mantissa, 4 bit exponent
+	}
+	return sensorData, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestDecodeGATTReadings(t *testing.T) {
+	flora, err := decodeFloraReading([]byte{0xf6, 0xff, 0x00, 0xe8, 0x03, 0x00, 0x00, 0x1e, 0x64, 0x00, 0, 0, 0, 0, 0, 0}, []byte{0x5a, 0x2b})
+	if err != nil {
+		t.Fatalf("flora : %v", err)
+	}
+	if flora.TemperatureCelsius != -1 || flora.IlluminanceLux != 1000 || flora.BatteryPercent != 90 {
+		t.Errorf("flora : got %+v", flora)
+	}
+	lywsd03, err := decodeLYWSD03Reading([]byte{0x0c, 0x09, 0x37, 0x1c, 0x0b}) // 23.16C 55% 2.844V
+	if err != nil {
+		t.Fatalf("lywsd03 : %v", err)
+	}
+	if lywsd03.TemperatureCelsius != 23.16 || lywsd03.HumidityPercent != 55 || lywsd03.BatteryPercent < 68 || lywsd03.BatteryPercent > 69 {
+		t.Errorf("lywsd03 : got %+v", lywsd03)
+	}
+	if _, err := decodeLYWSD03Reading([]byte{0x0c}); err == nil {
+		t.Errorf("lywsd03 : short reading accepted")
+	}
+	sensorTag, err := decodeSensorTagReading([]byte{0x66, 0x66, 0x03, 0x80}, []byte{0x28, 0x0a, 0x00, 0xcd, 0x8b, 0x01}, []byte{0xc4, 0x29}) // 26C 50% 1013.25hPa 100lx
+	if err != nil {
+		t.Fatalf("sensortag : %v", err)
+	}
+	if sensorTag.TemperatureCelsius < 25.99 || sensorTag.TemperatureCelsius > 26.01 || sensorTag.HumidityPercent != 50 || sensorTag.PressurePascal != 101325 || sensorTag.IlluminanceLux != 100 {
+		t.Errorf("sensortag : got %+v", sensorTag)
+	}
+	if sensorTag, err = decodeSensorTagReading([]byte{0x66, 0x66, 0x00, 0x80}, nil, nil); err != nil || sensorTag.PressurePascal != undefined || sensorTag.IlluminanceLux != undefined {
+		t.Errorf("sensortag without barometer and light : got %+v, %v", sensorTag, err)
+	}
+	if _, err := decodeSensorTagReading([]byte{0x66}, nil, nil); err == nil {
+		t.Errorf("sensortag : short reading accepted")
+	}
+}
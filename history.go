@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Keeps the last -history-size decoded readings per device, for a quick look at
+// recent trends over http without needing a TSDB.
+
+type readingHistory struct {
+	readings []deviceReading // Fixed size ring buffer
+	next     int             // Where the next reading goes
+	full     bool            // Whether the buffer has wrapped around
+}
+
+var historyMap = make(map[string]*readingHistory) // MAC -> Recent readings
+var historyMutex = &sync.RWMutex{}
+
+func (h *readingHistory) add(reading deviceReading) {
+	h.readings[h.next] = reading
+	h.next = (h.next + 1) % len(h.readings)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+func (h *readingHistory) last() (deviceReading, bool) {
+	if !h.full && h.next == 0 {
+		return deviceReading{}, false
+	}
+	return h.readings[(h.next-1+len(h.readings))%len(h.readings)], true
+}
+
+func (h *readingHistory) list() []deviceReading { // Oldest first
+	if !h.full {
+		return append([]deviceReading{}, h.readings[:h.next]...)
+	}
+	return append(append([]deviceReading{}, h.readings[h.next:]...), h.readings[:h.next]...)
+}
+
+func recordHistory(reading *deviceReading) {
+	if flagHistorySize <= 0 {
+		return
+	}
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	h, ok := historyMap[reading.Mac]
+	if !ok {
+		h = &readingHistory{readings: make([]deviceReading, flagHistorySize)}
+		historyMap[reading.Mac] = h
+	}
+	h.add(*reading)
+}
+
+func deviceHistoryHandler(w http.ResponseWriter, r *http.Request) { // Serves /devices/<mac>/history
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices/"), "/"), "/")
+	if len(path) != 2 || path[1] != "history" {
+		http.NotFound(w, r)
+		return
+	}
+	historyMutex.RLock()
+	h, ok := historyMap[strings.ToLower(path[0])] // .Addr always returns lower case
+	var readings []deviceReading
+	if ok {
+		readings = h.list()
+	}
+	historyMutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readings)
+}
+
+// The battery drain is fitted over a slower history of its own, a reading every
+// batterySampleInterval for up to a week, as -history-size only covers minutes.
+
+const batterySampleInterval = time.Hour
+const batteryHistoryLength = 7 * 24
+const batteryDrainMinSpan = 48 * time.Hour // Whole percent steps need a long baseline, or a single step reads as a steep drain
+const batteryReplacedRise = 10             // Percent, a rise this big is a fresh battery and restarts the fit
+
+var batteryHistoryMap = make(map[string]*readingHistory) // MAC -> Hourly readings with a battery level
+var batteryHistoryMutex = &sync.RWMutex{}
+
+func recordBatteryDrain(reading *deviceReading, labels prometheus.Labels) {
+	if reading.BatteryPercent == nil {
+		return
+	}
+	batteryHistoryMutex.Lock()
+	h, ok := batteryHistoryMap[reading.Mac]
+	if ok {
+		last, _ := h.last()
+		if *reading.BatteryPercent-*last.BatteryPercent >= batteryReplacedRise {
+			ok = false
+		} else if time.Duration(reading.LastSeen-last.LastSeen)*time.Second < batterySampleInterval {
+			batteryHistoryMutex.Unlock()
+			return
+		}
+	}
+	if !ok {
+		h = &readingHistory{readings: make([]deviceReading, batteryHistoryLength)}
+		batteryHistoryMap[reading.Mac] = h
+	}
+	h.add(*reading)
+	samples := h.list()
+	batteryHistoryMutex.Unlock()
+	if drain, ok := batteryDrainPerDay(samples); ok {
+		metricsDeviceBatteryDrainGauge.Set(labels, drain)
+	}
+}
+
+func batteryDrainPerDay(samples []deviceReading) (float64, bool) { // Least squares slope of the battery level, as percent lost per day
+	if len(samples) < 3 || time.Duration(samples[len(samples)-1].LastSeen-samples[0].LastSeen)*time.Second < batteryDrainMinSpan {
+		return 0, false
+	}
+	var sumX, sumY, sumXX, sumXY float64
+	for _, s := range samples {
+		x := float64(s.LastSeen-samples[0].LastSeen) / 86400 // Days
+		y := *s.BatteryPercent
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	n := float64(len(samples))
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	if slope > 0 { // Voltage derived levels rise with temperature, that's no negative drain
+		return 0, true
+	}
+	return -slope, true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func batterySamples(start time.Time, step time.Duration, levels ...float64) []deviceReading {
+	var samples []deviceReading
+	for i, level := range levels {
+		level := level
+		samples = append(samples, deviceReading{LastSeen: start.Add(time.Duration(i) * step).Unix(), BatteryPercent: &level})
+	}
+	return samples
+}
+
+func TestBatteryDrainPerDay(t *testing.T) {
+	start := time.Now()
+	for _, tc := range []struct {
+		name    string
+		samples []deviceReading
+		want    float64
+		ok      bool
+	}{
+		{"steady 2 per day", batterySamples(start, 12*time.Hour, 90, 89, 88, 87, 86), 2, true},
+		{"flat", batterySamples(start, 24*time.Hour, 80, 80, 80), 0, true},
+		{"rising", batterySamples(start, 24*time.Hour, 80, 81, 82), 0, true},
+		{"too short a span", batterySamples(start, time.Hour, 90, 80, 70), 0, false}, // One quantization step would read as a steep drain
+		{"too few samples", batterySamples(start, 48*time.Hour, 90, 80), 0, false},
+	} {
+		got, ok := batteryDrainPerDay(tc.samples)
+		if ok != tc.ok || got-tc.want > 0.001 || got-tc.want < -0.001 {
+			t.Errorf("%s : got %g %v, want %g %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRecordBatteryDrainSampling(t *testing.T) {
+	mac := "aa:bb:cc:dd:ee:70"
+	labels := deviceLabels(mac, "", "ATC")
+	start := time.Now()
+	for _, sample := range batterySamples(start, 20*time.Minute, 90, 90, 90, 89) { // Only the first and the one an hour later are kept
+		sample.Mac = mac
+		recordBatteryDrain(&sample, labels)
+	}
+	batteryHistoryMutex.RLock()
+	kept := len(batteryHistoryMap[mac].list())
+	batteryHistoryMutex.RUnlock()
+	if kept != 2 {
+		t.Errorf("kept %d samples, want 2", kept)
+	}
+	fresh := 100.0
+	recordBatteryDrain(&deviceReading{Mac: mac, LastSeen: start.Add(2 * time.Hour).Unix(), BatteryPercent: &fresh}, labels) // Battery replaced
+	batteryHistoryMutex.RLock()
+	kept = len(batteryHistoryMap[mac].list())
+	batteryHistoryMutex.RUnlock()
+	if kept != 1 {
+		t.Errorf("kept %d samples after a battery change, want 1", kept)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Devices often advertise a Shortened Local Name (AD type 0x08) in some frames and the
+// Complete Local Name (0x09) in others, usually the scan response. The best name heard
+// is kept per mac, so a shortened name never replaces a complete one.
+
+type localName struct {
+	name     string
+	complete bool
+	last     time.Time // Last heard, for expireLocalNames
+}
+
+var localNameMap = make(map[string]*localName) // MAC -> Best advertised local name
+var localNameMutex = &sync.RWMutex{}
+
+func parseLocalNames(data []byte) (string, string) { // Returns the complete and the shortened local name in an advertisement, if any
+	var complete, short string
+	for p := 0; p < len(data)-1; {
+		length := int(data[p])
+		if length == 0 || p+length+1 > len(data) { // Padding, or a truncated structure the parser already complains about
+			break
+		}
+		switch data[p+1] {
+		case 0x08:
+			short = string(data[p+2 : p+length+1])
+		case 0x09:
+			complete = string(data[p+2 : p+length+1])
+		}
+		p += length + 1
+	}
+	return complete, short
+}
+
+func updateLocalName(mac string, fallback string, payloads ...[]byte) string { // Returns the best name known for the mac
+	var complete, short string
+	for _, payload := range payloads {
+		c, s := parseLocalNames(payload)
+		if len(c) > 0 {
+			complete = c
+		}
+		if len(s) > 0 {
+			short = s
+		}
+	}
+	if len(complete) == 0 && len(short) == 0 {
+		short = fallback // Completeness unknown (e.g. simulated advertisements), rank it lowest
+	}
+	localNameMutex.Lock()
+	defer localNameMutex.Unlock()
+	known, ok := localNameMap[mac]
+	if !ok {
+		known = &localName{}
+		localNameMap[mac] = known
+	}
+	known.last = time.Now()
+	if len(complete) > 0 {
+		known.name, known.complete = complete, true
+	} else if len(short) > 0 && !known.complete {
+		known.name = short
+	}
+	return known.name
+}
+
+func expireLocalNames(now time.Time) { // Forgets the devices not heard within -device-timeout
+	localNameMutex.Lock()
+	defer localNameMutex.Unlock()
+	for mac, known := range localNameMap {
+		if now.Sub(known.last) > flagDeviceTimeout {
+			delete(localNameMap, mac)
+		}
+	}
+}
+
+func bestLocalName(mac string) string {
+	localNameMutex.RLock()
+	defer localNameMutex.RUnlock()
+	if known, ok := localNameMap[mac]; ok {
+		return known.name
+	}
+	return ""
+}
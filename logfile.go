@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// -logfile sends the log to a file instead of stderr, reopened on SIGHUP so
+// logrotate can move it away.
+
+var logFile *os.File
+var logFileMutex = &sync.Mutex{}
+
+func openLogFile() error {
+	f, err := os.OpenFile(flagLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	logFileMutex.Lock()
+	defer logFileMutex.Unlock()
+	log.SetOutput(f)
+	log.SetPrefix(fmt.Sprintf("%s[%d] ", applicationName, os.Getpid())) // Several instances may share a file
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
+func reopenLogFile() {
+	if err := openLogFile(); err != nil {
+		logError("Failed to reopen %s, still logging to the old file - %v", flagLogFile, err)
+	}
+}
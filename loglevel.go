@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// -log-level picks how much is logged : error, warn, info (the default), debug (what
+// -verbose used to give) or trace (what -debug used to give, every advertisement).
+
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	levelTrace
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug", "trace"} // Indexed by logLevel
+
+var currentLogLevel = levelInfo
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return logLevel(level), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+func setLogLevel(level logLevel) { // Keeps the older -verbose and -debug checks in step
+	currentLogLevel = level
+	flagVerbose = level >= levelDebug
+	flagDebug = level >= levelTrace
+}
+
+func logAt(level logLevel, format string, args ...interface{}) {
+	if level <= currentLogLevel {
+		log.Printf(format, args...)
+	}
+}
+
+func logError(format string, args ...interface{}) { logAt(levelError, format, args...) }
+func logWarn(format string, args ...interface{})  { logAt(levelWarn, format, args...) }
+func logInfo(format string, args ...interface{})  { logAt(levelInfo, format, args...) }
+func logDebug(format string, args ...interface{}) { logAt(levelDebug, format, args...) }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogLevels(t *testing.T) {
+	defer func(level logLevel, verbose, debug bool) {
+		currentLogLevel, flagVerbose, flagDebug = level, verbose, debug
+	}(currentLogLevel, flagVerbose, flagDebug)
+	defer log.SetOutput(log.Writer())
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	level, err := parseLogLevel("WARN")
+	if err != nil {
+		t.Fatalf("parse : %v", err)
+	}
+	setLogLevel(level)
+	logInfo("hidden")
+	logWarn("shown")
+	if strings.Contains(out.String(), "hidden") || !strings.Contains(out.String(), "shown") {
+		t.Errorf("at warn got %q", out.String())
+	}
+	if flagVerbose || flagDebug {
+		t.Errorf("at warn got verbose %v debug %v", flagVerbose, flagDebug)
+	}
+	setLogLevel(levelTrace)
+	if !flagVerbose || !flagDebug {
+		t.Errorf("at trace got verbose %v debug %v", flagVerbose, flagDebug)
+	}
+	if _, err := parseLogLevel("loud"); err == nil {
+		t.Errorf("unknown level accepted")
+	}
+}
@@ -1,19 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,40 +35,115 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/visago/ble"
-	"github.com/visago/ble/linux"
+
+	"btle_exporter/decoders"
 )
 
 const applicationName = "btle_exporter"
-const undefined = -99.9
+const undefined = decoders.Undefined
+const deviceDumpInterval = time.Minute // How often -dump-devices-csv is refreshed, besides on exit
+const adapterBusyRetryInterval = 10 * time.Second
+const adapterStatusInterval = 10 * time.Second
+const exitNoDevice = 3 // -require-device-within expired, distinct from log.Fatal's 1
+const httpReadTimeout = 10 * time.Second
+const httpWriteTimeout = 30 * time.Second // Large scrapes over slow uplinks
+const httpIdleTimeout = 2 * time.Minute
+const rssiAggWindow = 10 * time.Second // How long -rssi-agg max/avg combine the RSSI of one device
 
 var flagAdapterID string
 var flagVerbose bool
 var flagVersion bool
 var flagDebug bool
+var flagLogLevel string
 var flagMetricsListen string
 var flagPIDFile string
 var flagNamesCSVFile string
+var flagConfig string
+var flagHeartbeatInterval time.Duration
+var flagSampleInterval time.Duration
+var flagAverageWindow time.Duration
+var flagSimulate bool
+var flagReplay string
+var flagCapture string
+var flagDecoderScale string
+var flagBatteryCurve string
+var flagExternalDecoder string
+var flagExternalDecoderTimeout time.Duration
+var flagCaptureMaxSize int64
+var flagFIFO string
+var flagMinRSSI int
+var flagMinPayloadLength int
+var flagMacAllow string
+var flagMacDeny string
+var flagCalibrationCSVFile string
+var flagJSONStdout bool
+var flagAllowDuplicates bool
+var flagStartupGrace time.Duration
+var flagHealthTimeout time.Duration
+var flagHistorySize int
+var flagNoLandingPage bool
+var flagNoMetricsCompression bool
+var flagRequireDeviceWithin time.Duration
+var flagMotionTimeout time.Duration
+var flagHTTPBasicAuth string
+var flagRediscoverAfter time.Duration
+var flagRoundTemperature float64
+var flagRoundHumidity float64
+var flagSkipCompanyIDs string
+var flagLogFile string
+var flagDumpDevicesCSV string
+var flagTUI bool
+var flagMinAdvCount int
+var flagMinAdvWindow time.Duration
+var flagDedupWindow time.Duration
+var flagNoDataRestart time.Duration
+var flagSanitizeNames string
+var flagLocation string
+var flagGATTPoll string
+var flagGATTPollInterval time.Duration
+var flagOTLPEndpoint string
+var flagOTLPInterval time.Duration
+var flagTemperatureMin float64
+var flagTemperatureMax float64
+var flagBatteryMin float64
+var flagSummaryInterval time.Duration
+var flagRSSIAgg string
+var flagWorkers int
+var flagPushgatewayURL string
+var flagPushgatewayJob string
+var flagPushgatewayInterval time.Duration
+var flagExportUnknown bool
+var flagExportAdapterSeen bool
+var flagDeviceUpGrace time.Duration
+var flagDeviceTimeout time.Duration
+var flagOnlyOnChange bool
+var flagChangeEpsilon float64
+var flagAlertRule string
+var flagAlertDebounce time.Duration
+var flagOnAlertCommand string
+var flagMQTTBroker string
+var flagMQTTTopicPrefix string
+var flagMQTTUsername string
+var flagMQTTPassword string
+var flagMQTTHADiscovery bool
+var flagMQTTHAPrefix string
 
 var BuildBranch string
 var BuildVersion string
 var BuildTime string
 var BuildRevision string
 
-type SensorData struct {
-	ID                 int
-	Type               int
-	Model              string
-	ModelID            int
-	TemperatureCelcius float64
-	HumidityPercent    float64
-	BatteryPercent     float64
-}
+type SensorData = decoders.SensorData
 
 var (
 	metricsAdvertisementCount = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "btle_exporter_advertisement_count",
 		Help: "The total number of btle advertisements counted",
 	})
+	metricsAdvertisementDeduplicatedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "btle_exporter_advertisement_deduplicated_count",
+		Help: "The total number of advertisements skipped as repeats within -dedup-window",
+	})
 	metricsAdvertisementSupportedCount = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "btle_exporter_advertisement_supported_count",
 		Help: "The total number of supported btle advertisements counted",
@@ -68,170 +156,883 @@ var (
 		Name: "btle_exporter_device_supported_count",
 		Help: "The total number of supported btle devices detected",
 	})
-	metricsDeviceTemperatureGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "btle_exporter_device_temperature_celcius",
-		Help: "Current temperature reading in celcius",
-	}, []string{"mac", "name", "model"},
+	metricsHeartbeatGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "btle_exporter_heartbeat_seconds",
+		Help: "Unixtimestamp of the last heartbeat, updated regardless of scan activity",
+	})
+	metricsAdapterUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "btle_exporter_adapter_up",
+		Help: "Whether the adapter is present and not rfkill blocked (1) or not (0), always 1 where the platform can't tell",
+	}, []string{"adapter"},
+	)
+	metricsAdapterInfoGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "btle_exporter_adapter_info",
+		Help: "Set to 1 with the bluetooth address of the controller behind each adapter, empty where the platform can't tell",
+	}, []string{"adapter", "address"},
 	)
-	metricsDeviceHumidityGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "btle_exporter_device_humidity_percent",
-		Help: "Current humidity reading in percent",
-	}, []string{"mac", "name", "model"},
+	metricsScanRestartCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btle_exporter_scan_restart_count",
+		Help: "The total number of scans restarted by -no-data-restart after the adapter went quiet",
+	}, []string{"adapter"},
 	)
-	metricsDeviceBatteryGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "btle_exporter_device_battery_percent",
-		Help: "Current battery reading in percent",
-	}, []string{"mac", "name", "model"},
+	metricsAdapterBusyGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "btle_exporter_adapter_busy",
+		Help: "Set to 1 while the bluetooth adapter is in use by another process",
+	})
+	metricsReadingRejectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btle_exporter_reading_rejected_count",
+		Help: "The total number of decoded readings dropped for being implausible",
+	}, []string{"reason"},
 	)
-	metricsDeviceSignalGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "btle_exporter_device_signal_rssi",
-		Help: "Current signal strength rSSI",
-	}, []string{"mac", "name", "model"},
+	metricsModelLastSeenGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "btle_exporter_model_last_seen_seconds",
+		Help: "Unixtimestamp of when any device of the model was last decoded",
+	}, []string{"model"},
 	)
-	metricsDeviceAdvertisementCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	metricsDeviceAdvertisementCount = newDeviceCounterVec(prometheus.CounterOpts{
 		Name: "btle_exporter_device_advertisement_count",
-		Help: "Total number of adevertisements detected",
-	}, []string{"mac", "name", "model"},
+		Help: "Total number of advertisements detected",
+	})
+	metricsHandlerPanicCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "btle_exporter_handler_panic_count",
+		Help: "The total number of advertisements whose handling panicked and was recovered",
+	})
+	metricsAdvertisementParseErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btle_exporter_advertisement_parse_error_count",
+		Help: "The total number of advertisements that failed to parse (truncated or corrupt), by the model identified so far",
+	}, []string{"model"},
+	)
+	metricsAdvertisementProcessSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "btle_exporter_advertisement_process_seconds",
+		Help:    "Time spent handling an advertisement, from decoding to the last output",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10), // 10us to 2.6s
+	}, []string{"model"},
 	)
-	metricsDeviceAdvertisementLastSeenGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "btle_exporter_device_advertisement_lastseen_seconds",
-		Help: "Unixtimestamp of when the last time advertisment was seen",
-	}, []string{"mac", "name", "model"},
+	metricsAdapterAdvertisementCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btle_exporter_adapter_advertisement_count",
+		Help: "The total number of btle advertisements heard by each adapter",
+	}, []string{"adapter"},
 	)
+	metricsAdvertisementByTypeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btle_exporter_advertisement_by_type_count",
+		Help: "The total number of AD structures seen in advertisements, by AD type",
+	}, []string{"type"},
+	)
+	metricsDevicePayloadChangedCount = newDeviceCounterVec(prometheus.CounterOpts{
+		Name: "btle_exporter_device_payload_changed_count",
+		Help: "Total number of advertisements whose payload differed from the previous one of the device, static beacons never change",
+	})
 )
 
-var discoverMap = make(map[string]bool) // Mac -> Discovered?
-var timeOutMap = make(map[string]int64) // Mac -> Discovered?
-var namesMap = make(map[string]string)  // MAC -> Name
+// Every shared map is written from the scan callback and read from other
+// goroutines (http, reloads, decay), so each one has its own mutex next to it.
 
-var timeOutMutex = &sync.Mutex{}
+type discoveredDevice struct {
+	last      time.Time
+	localName string // Best advertised local name
+	model     string
+}
 
-func bluetoothScan() error {
-	d, err := linux.NewDeviceWithName(flagAdapterID)
+var discoverMap = make(map[string]*discoveredDevice) // Mac -> Last heard
+var discoverMutex = &sync.RWMutex{}
+var timeOutMap = make(map[string]int64) // Mac -> Last seen (unix)
+var timeOutMutex = &sync.RWMutex{}
+var namesMap = make(map[string]string) // MAC -> Name
+var namesMutex = &sync.RWMutex{}
+var sampleMap = make(map[string]int64) // MAC -> Last processed (unix nano)
+var sampleMutex = &sync.RWMutex{}
+var heardMap = make(map[string]*heardState) // MAC -> Advertisements heard within -min-adv-window
+var heardMutex = &sync.RWMutex{}
+var rssiMap = make(map[string]*rssiState) // MAC -> RSSI heard within rssiAggWindow
+var rssiMutex = &sync.RWMutex{}
+var payloadHashMap = make(map[string]*payloadHashState) // MAC -> Hash of the last payload
+var payloadHashMutex = &sync.RWMutex{}
+var dedupMap = make(map[string]*dedupState) // MAC -> Last processed payload, for -dedup-window
+var dedupMutex = &sync.RWMutex{}
+
+type deviceReading struct { // A decoded reading, as serialised for consumers outside of prometheus
+	Mac                string   `json:"mac"`
+	Name               string   `json:"name"`
+	RawName            string   `json:"raw_name,omitempty"` // Only when -sanitize-names changed it
+	LocalName          string   `json:"local_name,omitempty"`
+	Model              string   `json:"model"`
+	RSSI               int      `json:"rssi"`
+	LastSeen           int64    `json:"lastseen"`
+	TemperatureCelsius *float64 `json:"temperature_celsius,omitempty"`
+	HumidityPercent    *float64 `json:"humidity_percent,omitempty"`
+	BatteryPercent     *float64 `json:"battery_percent,omitempty"`
+	CO2PPM             *float64 `json:"co2_ppm,omitempty"`
+	PressurePascal     *float64 `json:"pressure_pascal,omitempty"`
+	VOCIndex           *float64 `json:"voc_index,omitempty"`
+	SpecificGravity    *float64 `json:"gravity,omitempty"`
+	Color              string   `json:"color,omitempty"`
+	IlluminanceLux     *float64 `json:"illuminance_lux,omitempty"`
+	DewPointCelsius    *float64 `json:"dewpoint_celsius,omitempty"`
+	HeartRateBPM       *float64 `json:"heart_rate_bpm,omitempty"`
+	AccelerationXG     *float64 `json:"acceleration_x_g,omitempty"`
+	AccelerationYG     *float64 `json:"acceleration_y_g,omitempty"`
+	AccelerationZG     *float64 `json:"acceleration_z_g,omitempty"`
+	TxPowerDBm         *float64 `json:"tx_power_dbm,omitempty"`
+	Motion             *float64 `json:"motion,omitempty"`
+}
+
+func definedValue(value float64) *float64 { // Maps the undefined sentinel to a nil (omitted) value
+	if value == undefined {
+		return nil
+	}
+	return &value
+}
+
+func logValue(value float64) string { // Shows the undefined sentinel as n/a, -99.9 in a log line looks like a broken sensor
+	if value == undefined {
+		return "n/a"
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64)
+}
+
+func newDeviceReading(mac string, name string, rssi int, lastSeen time.Time, sensorData *SensorData) *deviceReading {
+	rawName := rawMacName(mac)
+	if rawName == name {
+		rawName = ""
+	}
+	return &deviceReading{
+		Mac:                mac,
+		Name:               name,
+		RawName:            rawName,
+		LocalName:          bestLocalName(mac),
+		Model:              sensorData.Model,
+		RSSI:               rssi,
+		LastSeen:           lastSeen.Unix(),
+		TemperatureCelsius: definedValue(sensorData.TemperatureCelsius),
+		HumidityPercent:    definedValue(sensorData.HumidityPercent),
+		BatteryPercent:     definedValue(sensorData.BatteryPercent),
+		CO2PPM:             definedValue(sensorData.CO2PPM),
+		PressurePascal:     definedValue(sensorData.PressurePascal),
+		VOCIndex:           definedValue(sensorData.VOCIndex),
+		SpecificGravity:    definedValue(sensorData.SpecificGravity),
+		Color:              sensorData.Color,
+		IlluminanceLux:     definedValue(sensorData.IlluminanceLux),
+		DewPointCelsius:    definedValue(sensorData.DewPointCelsius),
+		HeartRateBPM:       definedValue(sensorData.HeartRateBPM),
+		AccelerationXG:     definedValue(sensorData.AccelerationX),
+		AccelerationYG:     definedValue(sensorData.AccelerationY),
+		AccelerationZG:     definedValue(sensorData.AccelerationZ),
+		TxPowerDBm:         definedValue(sensorData.TxPowerDBm),
+		Motion:             definedValue(sensorData.Motion),
+	}
+}
+
+var jsonStdoutEncoder = json.NewEncoder(os.Stdout) // Logs go to stderr, so stdout stays clean json
+
+type calibration struct {
+	TemperatureOffset float64
+	HumidityOffset    float64
+}
+
+var calibrationMap = make(map[string]calibration) // MAC or model -> Offsets
+var calibrationMutex = &sync.RWMutex{}
+
+var startTime = time.Now()
+var lastAdvertisementTime int64 // Unix time of the last advertisement from any device, accessed atomically
+
+type motionState struct {
+	lastDetected time.Time
+	label        prometheus.Labels
+}
+
+var motionMap = make(map[string]*motionState) // MAC -> Last motion detection
+var motionMutex = &sync.RWMutex{}
+
+var ignoredModels = map[string]bool{ // Identified, but carry no sensor data worth exporting
+	"AppleContinuity": true,
+	"FastPair":        true,
+	"Skipped":         true, // -skip-company-ids
+}
+
+var skipCompanyIDs = make(map[uint16]bool) // Manufacturer data company IDs from -skip-company-ids
+
+func adapterIDs() []string { // -adapterID takes a comma separated list, to listen on several adapters at once
+	var ids []string
+	for _, id := range strings.Split(flagAdapterID, ",") {
+		if id = strings.TrimSpace(id); len(id) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func openAdapter(adapterID string) ble.Device {
+	d, err := newDevice(adapterID)
+	for err != nil && errors.Is(err, syscall.EBUSY) { // Someone else holds the adapter, keep retrying rather than dying cryptically
+		metricsAdapterBusyGauge.Set(1)
+		logWarn("Adapter %s is busy (%s) - stop bluetoothd (systemctl stop bluetooth) or the other btle_exporter instance using it. Retrying in %s", adapterID, err, adapterBusyRetryInterval)
+		time.Sleep(adapterBusyRetryInterval)
+		d, err = newDevice(adapterID)
+	}
+	metricsAdapterBusyGauge.Set(0)
 	if err != nil {
-		log.Fatalf("can't new device : %s", err)
+		log.Fatalf("can't new device %s : %s", adapterID, err)
 	}
-	ble.SetDefaultDevice(d)
-	log.Printf("Scanning... (forever)")
+	setAdapterInfo(adapterID, adapterAddress(d))
+	return d
+}
+
+func adapterAddress(d ble.Device) string { // The controller's own address, stable where hciN isn't. Empty where the backend can't tell (CoreBluetooth)
+	if addressed, ok := d.(interface{ Address() ble.Addr }); ok && addressed.Address() != nil {
+		return strings.ToLower(addressed.Address().String())
+	}
+	return ""
+}
+
+var adapterInfoMap = make(map[string]string) // Adapter -> Address as exported
+var adapterInfoMutex = &sync.Mutex{}
+
+func setAdapterInfo(adapterID string, address string) {
+	adapterInfoMutex.Lock()
+	defer adapterInfoMutex.Unlock()
+	old, ok := adapterInfoMap[adapterID]
+	if ok && old != address { // Another controller took the name, e.g. after a replug
+		metricsAdapterInfoGauge.Delete(prometheus.Labels{"adapter": adapterID, "address": old})
+	}
+	if (!ok || old != address) && len(address) > 0 {
+		logInfo("Adapter %s has address %s", adapterID, address)
+	}
+	adapterInfoMap[adapterID] = address
+	metricsAdapterInfoGauge.With(prometheus.Labels{"adapter": adapterID, "address": address}).Set(1)
+}
+
+func adapterScanHandler(adapterID string) ble.AdvHandler { // Tags the advertisements with the adapter that heard them
+	counter := metricsAdapterAdvertisementCount.With(prometheus.Labels{"adapter": adapterID})
+	return func(a ble.Advertisement) {
+		counter.Inc()
+		if flagExportAdapterSeen {
+			recordAdapterSeen(a.Addr().String(), adapterID, time.Now())
+		}
+		dispatchAdvertisement(a)
+	}
+}
+
+func scanAdapter(ctx context.Context, adapterID string, d ble.Device, first bool) error { // Scans until ctx ends, reopening the adapter whenever -no-data-restart finds it deaf
+	handler := adapterScanHandler(adapterID)
+	for {
+		scanCtx, cancel := context.WithCancel(ctx)
+		last := time.Now().UnixNano() // Accessed atomically
+		var deaf int32
+		if flagNoDataRestart > 0 {
+			go scanWatchdog(scanCtx, cancel, &last, &deaf, flagNoDataRestart)
+		}
+		// allowDup only toggles the controller's duplicate filter (LE Set Scan Enable, Filter_Duplicates), it does not
+		// select active/passive scanning. With duplicates filtered the controller reports each device about once per scan,
+		// so readings stop updating - keep it on for continuous monitoring.
+		err := d.Scan(scanCtx, flagAllowDuplicates, func(a ble.Advertisement) {
+			atomic.StoreInt64(&last, time.Now().UnixNano())
+			handler(a)
+		})
+		cancel()
+		if atomic.LoadInt32(&deaf) == 0 {
+			return err
+		}
+		metricsScanRestartCount.With(prometheus.Labels{"adapter": adapterID}).Inc()
+		logWarn("No advertisements on %s for %s, restarting the scan", adapterID, flagNoDataRestart)
+		d.Stop()
+		d = openAdapter(adapterID)
+		if first {
+			ble.SetDefaultDevice(d)
+		}
+	}
+}
+
+func scanWatchdog(ctx context.Context, cancel context.CancelFunc, last *int64, deaf *int32, timeout time.Duration) { // Cancels the scan once nothing was heard for timeout
+	interval := timeout / 10
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(last))) >= timeout {
+				atomic.StoreInt32(deaf, 1)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func adapterStatusPeriodically(adapterIDs []string) { // Flips btle_exporter_adapter_up on unplug or rfkill, before the scan errors
+	for {
+		for _, adapterID := range adapterIDs {
+			up := 1.0
+			if !adapterUp(adapterID) {
+				up = 0
+			}
+			metricsAdapterUpGauge.With(prometheus.Labels{"adapter": adapterID}).Set(up)
+		}
+		time.Sleep(adapterStatusInterval)
+	}
+}
+
+func bluetoothScan() error {
+	go adapterStatusPeriodically(adapterIDs())
+	var devices []ble.Device
+	for _, adapterID := range adapterIDs() {
+		devices = append(devices, openAdapter(adapterID))
+	}
+	ble.SetDefaultDevice(devices[0])     // GATT polling connects through the first adapter
+	for _, mac := range gattPollMACs() { // Needs the default device for ble.Dial
+		go gattPoll(mac)
+	}
+	logInfo("Scanning on %s... (forever)", strings.Join(adapterIDs(), ", "))
 	ctx := ble.WithSigHandler(context.Background(), nil)
-	return ble.Scan(ctx, true, advScanHandler, nil)
+	errs := make(chan error, len(devices))
+	for i, d := range devices {
+		go func(adapterID string, d ble.Device, first bool) {
+			err := scanAdapter(ctx, adapterID, d, first)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				logError("Scanning on %s stopped - %v", adapterID, err)
+			}
+			errs <- err
+		}(adapterIDs()[i], d, i == 0)
+	}
+	var err error
+	for range devices {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type simulatedAdvertisement struct { // Implements ble.Advertisement for synthetic advertisements
+	addr      string
+	rssi      int
+	data      []byte
+	localName string
+}
+
+func (a *simulatedAdvertisement) LocalName() string              { return a.localName }
+func (a *simulatedAdvertisement) ManufacturerData() []byte       { return nil }
+func (a *simulatedAdvertisement) ServiceData() []ble.ServiceData { return nil }
+func (a *simulatedAdvertisement) Services() []ble.UUID           { return nil }
+func (a *simulatedAdvertisement) OverflowService() []ble.UUID    { return nil }
+func (a *simulatedAdvertisement) TxPowerLevel() int              { return 127 } // Not present
+func (a *simulatedAdvertisement) Connectable() bool              { return false }
+func (a *simulatedAdvertisement) SolicitedService() []ble.UUID   { return nil }
+func (a *simulatedAdvertisement) ScanResponse() []byte           { return nil }
+func (a *simulatedAdvertisement) EventType() uint8               { return 0x03 } // ADV_NONCONN_IND
+func (a *simulatedAdvertisement) Data() []byte                   { return a.data }
+func (a *simulatedAdvertisement) RSSI() int                      { return a.rssi }
+func (a *simulatedAdvertisement) Addr() ble.Addr                 { return ble.NewAddr(a.addr) }
+
+var simulatedFixtures = []struct { // One advertisement per supported model
+	mac  string
+	data string
+}{
+	{"4c:65:a8:00:00:01", "020106151695fe5020aa0101010000a8654c0d1004e4005a02"},             // LYWSDCGQ 22.8C 60.2%
+	{"a4:c1:38:00:00:02", "02010610161a18a4c13800000200f43c420bb80a"},                       // ATC 24.4C 60% 66%
+	{"a4:c1:38:00:00:0a", "02010611161a18a4c13800000a00f417a5420bb80a"},                     // ATC2 (two byte humidity) 24.4C 60.53% 66%
+	{"a4:c1:38:00:00:07", "02010612161a1807000038c1a4f3fdd61f860b552104"},                   // pvvx custom -5.25C 81.5% 85%
+	{"d0:12:34:00:00:03", "19ff020721130401000c0f015802c20194272d5a012c012a0007"},           // Aranet4 600ppm 22.5C 1013.2hPa 45% 90%
+	{"e0:11:22:00:00:04", "1aff4c000215a495bb10c5b14b44b5121370f02d74de004403f8c5"},         // Tilt Red 68F 1.016
+	{"78:11:dc:00:00:05", "020106141695fe5020f60701050000dc1178071003640000"},               // MJYD02YL 100lx (unencrypted)
+	{"54:ef:44:00:00:06", "020106141695fe50208d0a0106000044ef540f00032c0100"},               // RTCGQ02LM motion 300lx (unencrypted)
+	{"f4:5e:ab:00:00:08", "02010611ff330117560e1000e600fb01f4008b0100"},                     // BlueMaestro 25.1C 50% dew point 13.9C 86%
+	{"c7:3a:00:00:00:0b", "02010611ff990403298145ce1efc18f94202ca0b53"},                     // Ruuvi format 3 -1.69C 20.5% 1027.66hPa 2.899V
+	{"cb:b8:33:00:00:0f", "0201061bff99040512fc5394c37c0004fffc040cac364200cdcbb8334c884f"}, // RuuviTag5 24.3C 53.49% 1000.44hPa 2.977V
+	{"a4:c1:38:00:00:09", "0201060cff0188ec0001016608c61158"},                               // GoveeH5179 21.5C 45.5% 88%
+	{"a0:9e:1a:00:00:0c", "02010605160d180048"},                                             // Heart rate broadcast 72bpm
+	{"a4:c1:38:00:00:0d", "020106151695fe50205b05030d000038c1a40d1004e4005a02"},             // LYWSD03MMC pvvx Mi-like 22.8C 60.2%
+	{"a4:c1:38:00:00:0e", "02010609ff88ec0003d9a36400"},                                     // GVH5075 25.2C 32.3% 100%
+	{"b7:40:00:00:00:12", "0201060c16d2fc40016102c409035512"},                               // BTHome v2 25C 46.93% 97%
+	{"49:42:53:00:00:11", "02010604097370730aff3408b80d0012345508"},                         // Inkbird IBS-TH1 21C 35.12% 85%
+	{"e4:5b:00:00:00:10", "0201060916000d5400e4059635"},                                     // SwitchBotMeter 22.5C 53% 100%
+}
+
+func simulateScan() { // Feeds the fixtures through the scan handler on a timer, forever
+	logInfo("Simulating... (forever)")
+	handler := adapterScanHandler("simulated")
+	for {
+		for _, fixture := range simulatedFixtures {
+			data, err := hex.DecodeString(fixture.data)
+			if err != nil {
+				log.Fatalf("Bad simulated fixture for %s : %v", fixture.mac, err)
+			}
+			handler(&simulatedAdvertisement{addr: fixture.mac, rssi: -50 - rand.Intn(30), data: data})
+		}
+		time.Sleep(2 * time.Second)
+	}
 }
 
 func advScanHandler(a ble.Advertisement) {
+	start := time.Now()
+	processedModel := "Unknown"
+	defer func() {
+		metricsAdvertisementProcessSeconds.With(prometheus.Labels{"model": processedModel}).Observe(time.Since(start).Seconds())
+	}()
+	// The library may reuse its buffer once we return, only ever work on a copy
+	advReportData := append([]byte(nil), a.Data()...)
+	defer func() { // A decoder bug must not take down the scanner for every other device
+		if r := recover(); r != nil {
+			metricsHandlerPanicCount.Inc()
+			logError("Recovered from panic handling advertisement from %s (%x) : %v", a.Addr(), advReportData, r)
+		}
+	}()
+	atomic.StoreInt64(&lastAdvertisementTime, time.Now().Unix())
+	if len(flagCapture) > 0 {
+		writeCapture(a.Addr().String(), a.RSSI(), advReportData)
+	}
+	if reason := filterReason(a.Addr().String(), a.RSSI(), len(advReportData)); len(reason) > 0 {
+		recordFiltered(a.Addr().String(), a.RSSI(), reason, time.Now())
+		return
+	}
+	if flagDedupWindow > 0 && duplicateFrame(a.Addr().String(), advReportData, time.Now()) {
+		metricsAdvertisementCount.Inc() // Still a frame heard
+		metricsAdvertisementDeduplicatedCount.Inc()
+		return
+	}
 	var flag_connectable string
 	if a.Connectable() {
 		flag_connectable = "Connectable"
 	} else {
 		flag_connectable = "NotConnectable"
 	}
-	advReportData := a.Data()
-	sensorData, err := parseAdvertisementReportData(a)
+	localName := updateLocalName(a.Addr().String(), a.LocalName(), advReportData, a.ScanResponse())
+	sensorData, err := parseAdvertisementReportData(advReportData, localName)
+	processedModel = sensorData.Model
 	if err != nil {
-		if !discoverMap[a.Addr().String()] || flagDebug { // Consider a bad scan discovered !
-			log.Printf("Cannot parse advertisement data : %s", err)
-			discoverMap[a.Addr().String()] = true
+		metricsAdvertisementParseErrorCount.With(prometheus.Labels{"model": sensorData.Model}).Inc()
+		if _, announce := markDiscovered(a.Addr().String(), localName, ""); announce || flagDebug { // Consider a bad scan discovered !
+			logWarn("Cannot parse advertisement data : %s", err)
 		}
 		return
 	}
-	name := getMacName(a.Addr().String())
-	if sensorData.Model != "Unknown" { // We know how to process the data
-		label := prometheus.Labels{"mac": a.Addr().String(), "name": name, "model": sensorData.Model}
-		if sensorData.TemperatureCelcius != undefined {
-			metricsDeviceTemperatureGauge.With(label).Set(sensorData.TemperatureCelcius)
-		}
-		if sensorData.HumidityPercent != undefined {
-			metricsDeviceHumidityGauge.With(label).Set(sensorData.HumidityPercent)
+	if sensorData.Model == "Unknown" && len(flagExternalDecoder) > 0 {
+		if decoded := externalDecode(a.Addr().String(), a.RSSI(), advReportData); decoded != nil {
+			sensorData = decoded
+			processedModel = sensorData.Model
 		}
-		if sensorData.BatteryPercent != undefined {
-			metricsDeviceBatteryGauge.With(label).Set(sensorData.BatteryPercent)
-		}
-		metricsDeviceAdvertisementCount.With(label).Inc()
-		metricsDeviceSignalGauge.With(label).Set(float64(a.RSSI()))
-		metricsDeviceAdvertisementLastSeenGauge.With(label).Set(float64(time.Now().Unix()))
+	}
+	applyModelOverride(a.Addr().String(), sensorData)
+	countModelAdvertisement(sensorData.Model)
+	known := sensorData.Model != "Unknown" && !ignoredModels[sensorData.Model] // We know how to process the data
+	heard := (known || flagExportUnknown && sensorData.Model == "Unknown") && heardEnough(a.Addr().String())
+	if known && heard { // Unknown devices and rotating addresses would just churn series
+		countPayloadChange(a.Addr().String(), sensorData.Model, advReportData)
+	}
+	rssi := aggregateRSSI(a.Addr().String(), a.RSSI()) // Before sampling, so every frame counts towards max/avg
+	if flagSampleInterval > 0 && sampleable(sensorData) && !sampleDue(a.Addr().String()) {
+		metricsAdvertisementCount.Inc() // Still count every frame for traffic visibility
+		return
+	}
+	name := getMacName(a.Addr().String())
+	applyCalibration(a.Addr().String(), sensorData)
+	rejectImplausibleReadings(sensorData)
+	if known && heard {
+		exportReading(a.Addr().String(), name, rssi, sensorData)
+		metricsDeviceAdvertisementCount.Inc(deviceLabels(a.Addr().String(), name, sensorData.Model))
 		metricsAdvertisementSupportedCount.Inc()
+		countModelDecoded(sensorData.Model)
+	} else if flagExportUnknown && sensorData.Model == "Unknown" && heard { // Presence only, for devices without a decoder
+		exportPresence(a.Addr().String(), name, rssi)
 	}
 	timeOutMutex.Lock()
 	timeOutMap[a.Addr().String()] = time.Now().Unix()
 	timeOutMutex.Unlock()
 	metricsAdvertisementCount.Inc()
 
-	if !discoverMap[a.Addr().String()] || flagDebug {
+	if discovered, announce := markDiscovered(a.Addr().String(), localName, sensorData.Model); announce || flagDebug {
 		if sensorData != nil && sensorData.Model != "Unknown" && sensorData.Model != "Error" && sensorData.Model != "Unsupported" {
-			log.Printf("[%s] Name: %s RSSI:%3d Temp:%0.01f Humidity:%0.01f Batt:%0.01f ModelID:0x%04x, ID:%0d Type:%0d [%s %s]",
+			logInfo("[%s] Name: %s RSSI:%3d Temp:%s Humidity:%s Batt:%s ModelID:0x%04x, ID:%0d Type:%0d [%s %s]",
 				a.Addr(), name, a.RSSI(),
-				sensorData.TemperatureCelcius,
-				sensorData.HumidityPercent,
-				sensorData.BatteryPercent,
+				logValue(sensorData.TemperatureCelsius),
+				logValue(sensorData.HumidityPercent),
+				logValue(sensorData.BatteryPercent),
 				sensorData.ModelID, sensorData.ID, sensorData.Type, flag_connectable, sensorData.Model)
-			metricsDeviceSupportedCount.Inc()
-		} else {
-			if flagVerbose {
-				log.Printf("[%s] Name: %s RSSI:%3d Data: %s [%0d] [%s %s]", a.Addr(), a.LocalName(), a.RSSI(), hex.EncodeToString(advReportData), len(advReportData), flag_connectable, sensorData.Model)
+			if discovered {
+				metricsDeviceSupportedCount.Inc()
+			}
+		} else if !ignoredModels[sensorData.Model] || flagDebug {
+			logDebug("[%s] Name: %s RSSI:%3d Data: %s [%0d] [%s %s]", a.Addr(), localName, a.RSSI(), hex.EncodeToString(advReportData), len(advReportData), flag_connectable, sensorData.Model)
+		}
+		if discovered {
+			metricsDeviceCount.Inc()
+		}
+	}
+}
+
+func exportReading(mac string, name string, rssi int, sensorData *SensorData) { // Sets the device gauges and feeds every other consumer of a decoded reading
+	if flagAverageWindow > 0 {
+		averageReadings(mac, sensorData, time.Now())
+	}
+	roundReadings(sensorData)
+	label := deviceLabels(mac, name, sensorData.Model)
+	if sensorData.TemperatureCelsius != undefined {
+		metricsDeviceTemperatureGauge.Set(label, sensorData.TemperatureCelsius)
+	}
+	if sensorData.HumidityPercent != undefined {
+		metricsDeviceHumidityGauge.Set(label, sensorData.HumidityPercent)
+	}
+	if sensorData.BatteryPercent != undefined {
+		metricsDeviceBatteryGauge.Set(label, sensorData.BatteryPercent)
+	}
+	if sensorData.CO2PPM != undefined {
+		metricsDeviceCO2Gauge.Set(label, sensorData.CO2PPM)
+	}
+	if sensorData.PressurePascal != undefined {
+		metricsDevicePressureGauge.Set(label, sensorData.PressurePascal)
+	}
+	if sensorData.VOCIndex != undefined {
+		metricsDeviceVOCGauge.Set(label, sensorData.VOCIndex)
+	}
+	if sensorData.SpecificGravity != undefined {
+		gravityLabel := deviceLabels(mac, name, sensorData.Model)
+		gravityLabel["color"] = sensorData.Color
+		metricsDeviceGravityGauge.Set(gravityLabel, sensorData.SpecificGravity)
+	}
+	if sensorData.IlluminanceLux != undefined {
+		metricsDeviceIlluminanceGauge.Set(label, sensorData.IlluminanceLux)
+	}
+	if sensorData.DewPointCelsius != undefined {
+		metricsDeviceDewPointGauge.Set(label, sensorData.DewPointCelsius)
+	}
+	if sensorData.HeartRateBPM != undefined {
+		metricsDeviceHeartRateGauge.Set(label, sensorData.HeartRateBPM)
+	}
+	for axis, acceleration := range map[string]float64{"x": sensorData.AccelerationX, "y": sensorData.AccelerationY, "z": sensorData.AccelerationZ} {
+		if acceleration != undefined {
+			axisLabel := deviceLabels(mac, name, sensorData.Model)
+			axisLabel["axis"] = axis
+			metricsDeviceAccelerationGauge.Set(axisLabel, acceleration)
+		}
+	}
+	if sensorData.TxPowerDBm != undefined {
+		metricsDeviceTxPowerGauge.Set(label, sensorData.TxPowerDBm)
+	}
+	if sensorData.Motion != undefined {
+		motionDetected(mac, label)
+	}
+	metricsDeviceSignalGauge.Set(label, float64(rssi))
+	markDeviceUp(mac, label)
+	if flagExportAdapterSeen {
+		exportAdapterSeen(mac, label)
+	}
+	seen := time.Now() // visago/ble v1.0.0 advertisements carry no reception timestamp, so the handler time is the best we have
+	metricsDeviceAdvertisementLastSeenGauge.Set(label, float64(seen.Unix()))
+	metricsModelLastSeenGauge.With(prometheus.Labels{"model": sensorData.Model}).Set(float64(seen.Unix()))
+	reading := newDeviceReading(mac, name, rssi, seen, sensorData)
+	merged := recordDevice(reading)
+	merged.Motion = reading.Motion // An event, not a state to carry over
+	recordBatteryDrain(reading, label)
+	checkAlerts(reading)
+	if flagOnlyOnChange && !readingChanged(reading, flagChangeEpsilon) { // The gauges above are cheap, the outputs below are not
+		return
+	}
+	recordHistory(reading)
+	mqttPublish(&merged) // Home Assistant templates read every field from each message
+	if len(flagFIFO) > 0 {
+		writeFIFO(reading)
+	}
+	if flagJSONStdout {
+		if err := jsonStdoutEncoder.Encode(reading); err != nil {
+			logWarn("Failed to write json reading to stdout - %v", err)
+		}
+	}
+}
+
+type heardState struct {
+	count int
+	last  time.Time
+}
+
+func heardEnough(mac string) bool { // Passers-by heard only once or twice never get series of their own
+	if flagMinAdvCount <= 1 {
+		return true
+	}
+	now := time.Now()
+	heardMutex.Lock()
+	defer heardMutex.Unlock()
+	h, ok := heardMap[mac]
+	if !ok || now.Sub(h.last) > flagMinAdvWindow { // Gone quiet for too long, start counting again
+		h = &heardState{}
+		heardMap[mac] = h
+	}
+	if h.count < flagMinAdvCount {
+		h.count++
+	}
+	h.last = now
+	return h.count >= flagMinAdvCount
+}
+
+type rssiState struct {
+	start time.Time
+	max   int
+	sum   int
+	count int
+}
+
+func aggregateRSSI(mac string, rssi int) int { // Applies -rssi-agg over rssiAggWindow
+	if flagRSSIAgg == "last" {
+		return rssi
+	}
+	now := time.Now()
+	rssiMutex.Lock()
+	defer rssiMutex.Unlock()
+	r, ok := rssiMap[mac]
+	if !ok || now.Sub(r.start) > rssiAggWindow { // Window over, start a new one
+		r = &rssiState{start: now, max: rssi}
+		rssiMap[mac] = r
+	}
+	if rssi > r.max {
+		r.max = rssi
+	}
+	r.sum += rssi
+	r.count++
+	if flagRSSIAgg == "max" {
+		return r.max
+	}
+	return int(math.Round(float64(r.sum) / float64(r.count)))
+}
+
+func expireRSSI(now time.Time) { // Forgets the windows that are over, the next frame starts a new one anyway
+	rssiMutex.Lock()
+	defer rssiMutex.Unlock()
+	for mac, r := range rssiMap {
+		if now.Sub(r.start) > rssiAggWindow {
+			delete(rssiMap, mac)
+		}
+	}
+}
+
+type dedupState struct {
+	hash uint64
+	last time.Time
+}
+
+func duplicateFrame(mac string, payload []byte, now time.Time) bool { // Whether -dedup-window says to skip this frame
+	h := fnv.New64a()
+	h.Write(payload)
+	sum := h.Sum64()
+	dedupMutex.Lock()
+	defer dedupMutex.Unlock()
+	d, ok := dedupMap[mac]
+	if ok && d.hash == sum && now.Sub(d.last) < flagDedupWindow {
+		return true
+	}
+	dedupMap[mac] = &dedupState{hash: sum, last: now} // The window starts at the first frame of a repeat, so a steady payload is still processed once per window
+	return false
+}
+
+type payloadHashState struct {
+	hash uint64
+	last time.Time
+}
+
+func countPayloadChange(mac string, model string, payload []byte) {
+	h := fnv.New64a()
+	h.Write(payload)
+	sum := h.Sum64()
+	payloadHashMutex.Lock()
+	previous, seen := payloadHashMap[mac]
+	payloadHashMap[mac] = &payloadHashState{hash: sum, last: time.Now()}
+	payloadHashMutex.Unlock()
+	if seen && previous.hash != sum {
+		metricsDevicePayloadChangedCount.Inc(deviceLabels(mac, getMacName(mac), model))
+	}
+}
+
+func expirePayloadHashes(now time.Time) { // Forgets the devices not heard within -device-timeout
+	payloadHashMutex.Lock()
+	defer payloadHashMutex.Unlock()
+	for mac, p := range payloadHashMap {
+		if now.Sub(p.last) > flagDeviceTimeout {
+			delete(payloadHashMap, mac)
+		}
+	}
+}
+
+func markDiscovered(mac string, localName string, model string) (bool, bool) { // Returns whether the device is new, and whether it's worth announcing (new, or back after -rediscover-after)
+	now := time.Now()
+	discoverMutex.Lock()
+	defer discoverMutex.Unlock()
+	d, seen := discoverMap[mac]
+	if !seen {
+		d = &discoveredDevice{}
+		discoverMap[mac] = d
+	}
+	last := d.last
+	d.last = now
+	if len(localName) > 0 {
+		d.localName = localName
+	}
+	if len(model) > 0 {
+		d.model = model
+	}
+	return !seen, !seen || now.Sub(last) > flagRediscoverAfter
+}
+
+func dumpDevicesCSV() { // Writes every discovered device as a -names-csv seed file (mac,name,model)
+	discoverMutex.RLock()
+	lines := make([][]string, 0, len(discoverMap))
+	for mac, d := range discoverMap {
+		name := rawMacName(mac)
+		if len(name) == 0 {
+			name = d.localName
+		}
+		lines = append(lines, []string{mac, name, d.model})
+	}
+	discoverMutex.RUnlock()
+	sort.Slice(lines, func(i, j int) bool { return lines[i][0] < lines[j][0] })
+
+	tmpFile := flagDumpDevicesCSV + ".tmp" // Write aside and rename, so readers never see half a file
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		logWarn("Failed to create %s - %v", tmpFile, err)
+		return
+	}
+	w := csv.NewWriter(f)
+	w.WriteAll(lines)
+	if err := w.Error(); err != nil {
+		f.Close()
+		logWarn("Failed to write %s - %v", tmpFile, err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		logWarn("Failed to write %s - %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, flagDumpDevicesCSV); err != nil {
+		logWarn("Failed to rename %s - %v", tmpFile, err)
+		return
+	}
+	logDebug("Dumped %0d devices to %s", len(lines), flagDumpDevicesCSV)
+}
+
+func dumpDevicesCSVPeriodically() {
+	for {
+		time.Sleep(deviceDumpInterval)
+		dumpDevicesCSV()
+	}
+}
+
+func motionDetected(mac string, label prometheus.Labels) {
+	metricsDeviceMotionGauge.Set(label, 1)
+	motionMutex.Lock()
+	motionMap[mac] = &motionState{lastDetected: time.Now(), label: label}
+	motionMutex.Unlock()
+}
+
+func motionActive(mac string) bool { // Whether motion was detected within -motion-timeout
+	motionMutex.RLock()
+	defer motionMutex.RUnlock()
+	_, ok := motionMap[mac]
+	return ok
+}
+
+func motionDecay() { // Sensors only report detections, so fall back to 0 once they go quiet
+	for range time.Tick(time.Second) {
+		motionMutex.Lock()
+		for mac, m := range motionMap {
+			if time.Since(m.lastDetected) > flagMotionTimeout {
+				metricsDeviceMotionGauge.Set(m.label, 0)
+				delete(motionMap, mac)
 			}
 		}
-		discoverMap[a.Addr().String()] = true
-		metricsDeviceCount.Inc()
+		motionMutex.Unlock()
 	}
 }
 
-func parseAdvertisementReportData(a ble.Advertisement) (*SensorData, error) {
-	sensorData := &SensorData{}
-	sensorData.Model = "Unknown"
-	sensorData.TemperatureCelcius = undefined
-	sensorData.HumidityPercent = undefined
-	sensorData.BatteryPercent = undefined
-	advRawData := a.Data()
+func sampleable(sensorData *SensorData) bool { // Only supported models are tracked, and events (motion) are never dropped
+	return sensorData.Model != "Unknown" && !ignoredModels[sensorData.Model] && sensorData.Motion == undefined
+}
+
+func sampleDue(mac string) bool { // Limits processing of a device to once per sample interval
+	now := time.Now().UnixNano()
+	sampleMutex.Lock()
+	defer sampleMutex.Unlock()
+	if now-sampleMap[mac] < int64(flagSampleInterval) {
+		return false
+	}
+	sampleMap[mac] = now
+	return true
+}
+
+func exportPresence(mac string, name string, rssi int) { // The subset of exportReading that needs no decoded reading
+	label := deviceLabels(mac, name, "unknown")
+	metricsDeviceSignalGauge.Set(label, float64(rssi))
+	metricsDeviceAdvertisementLastSeenGauge.Set(label, float64(time.Now().Unix()))
+	metricsDeviceAdvertisementCount.Inc(label)
+	markDeviceUp(mac, label)
+}
+
+func newSensorData() *SensorData { // Every reading starts out absent
+	return decoders.NewSensorData()
+}
+
+func parseAdvertisementReportData(advRawData []byte, localName string) (*SensorData, error) { // localName is the best known for the device, possibly from an earlier scan response
+	sensorData := newSensorData()
 	packetPointer := 0
 	// https://docs.silabs.com/bluetooth/latest/general/adv-and-scanning/bluetooth-adv-data-basics
+	// Nothing here assumes the legacy 31 byte limit, extended advertising data (up to 1650 bytes) parses the
+	// same way. visago/ble v1.0.0 only handles legacy LE Advertising Reports though, so none arrive yet.
 	for packetPointer < len(advRawData)-1 {
 		advDataLength := int(advRawData[packetPointer])
+		if advDataLength == 0 { // Zero length is early termination, the rest is padding
+			break
+		}
+		if packetPointer+advDataLength+1 > len(advRawData) {
+			return sensorData, fmt.Errorf("AD structure at %d claims %d bytes but only %d remain", packetPointer, advDataLength, len(advRawData)-packetPointer-1)
+		}
 		advDataModel := int(advRawData[packetPointer+1])
-		advData := advRawData[packetPointer+2 : packetPointer+advDataLength+2]
-		if advDataModel == 0x16 { // Service Data - Bluetooth Core Specification:Vol. 3, Part C, sections 11.1.10 and 18.10 (v4.0
-			if advDataLength >= 18 && advData[0] == byte(0x95) && advData[1] == byte(0xFE) { // Xiaomi / YWSDCGQ - https://github.com/tsymbaliuk/Xiaomi-Thermostat-BLE
-				sensorData.Model = "Error"
-				sensorData.Type = int(advData[13])
-				sensorData.ID = int(advData[6])
-				// sensorData.Features = (int(advData[3]) << 8) + int(advData[2])
-				sensorData.ModelID = (int(advData[5]) << 8) + int(advData[4])
-				data_length := int(advData[15])
-				if sensorData.ModelID == 0x01aa { // LYWSDCG
-					sensorData.Model = "LYWSDCGQ"
-				} else if sensorData.ModelID == 0x045b { // LYWSD02
-					sensorData.Model = "Unsupported"
-				}
-				if sensorData.Type == 0x0D {
-					if data_length == 4 && advDataLength == 21 {
-						sensorData.TemperatureCelcius = float64((int(advData[17])<<8)+int(advData[16])) / 10
-						sensorData.HumidityPercent = float64((int(advData[19])<<8)+int(advData[18])) / 10
-					} else if data_length == 4 && advDataLength == 25 {
-						sensorData.TemperatureCelcius = float64((int(advData[17])<<8)+int(advData[16])) / 10
-						sensorData.HumidityPercent = float64((int(advData[19])<<8)+int(advData[18])) / 10
-						sensorData.BatteryPercent = float64(advData[23])
-					}
-				} else if sensorData.Type == 0x0A && data_length == 1 && advDataLength == 18 {
-					sensorData.BatteryPercent = float64(advData[16])
-				} else if sensorData.Type == 0x06 {
-					if data_length == 2 && advDataLength == 19 {
-						sensorData.HumidityPercent = float64((int(advData[17])<<8)+int(advData[16])) / 10
-					} else if data_length == 2 && advDataLength == 23 {
-						sensorData.HumidityPercent = float64((int(advData[17])<<8)+int(advData[16])) / 10
-						sensorData.BatteryPercent = float64(advData[21])
-					}
-				} else if sensorData.Type == 0x04 {
-					if data_length == 2 && advDataLength == 19 {
-						sensorData.TemperatureCelcius = float64((int(advData[17])<<8)+int(advData[16])) / 10
-					} else if data_length == 2 && advDataLength == 23 {
-						sensorData.TemperatureCelcius = float64((int(advData[17])<<8)+int(advData[16])) / 10
-						sensorData.BatteryPercent = float64(advData[21])
-					}
+		metricsAdvertisementByTypeCount.With(prometheus.Labels{"type": adTypeName(advDataModel)}).Inc()
+		advData := advRawData[packetPointer+2 : packetPointer+advDataLength+1]                                      // Length covers the type byte and the data
+		if advDataModel == 0xFF && advDataLength >= 3 && skipCompanyIDs[uint16(advData[1])<<8|uint16(advData[0])] { // -skip-company-ids, nothing else in the frame matters
+			sensorData.Model = "Skipped"
+			return sensorData, nil
+		}
+		decoder := decoders.FindNamed(localName, byte(advDataModel), advData)
+		if decoder == nil {
+			decoder = decoders.Find(byte(advDataModel), advData)
+		}
+		if decoder != nil {
+			decoded, err := decoder.Decode(byte(advDataModel), advData)
+			if decoded != nil {
+				decoded.FillBatteryPercent()
+				sensorData = decoded
+			}
+			if err != nil {
+				return sensorData, err
+			}
+		} else if advDataModel == 0x16 { // Service Data - Bluetooth Core Specification:Vol. 3, Part C, sections 11.1.10 and 18.10 (v4.0
+			if advDataLength >= 3 && advData[0] == byte(0x2C) && advData[1] == byte(0xFE) { // Google Fast Pair - https://developers.google.com/nearby/fast-pair/specifications/service/provider
+				sensorData.Model = "FastPair"
+			}
+		} else if advDataModel == 0xFF { // Manufacturer Specific Data - Bluetooth Core Specification:Vol. 3, Part C, section 18.11
+			if advDataLength >= 3 && advData[0] == byte(0x02) && advData[1] == byte(0x07) { // Aranet4 (SAF Tehnika, advertises service 0xFCE5) - https://github.com/Anrijs/Aranet4-Python
+				sensorData.Model = "Aranet4"
+				if advDataLength >= 24 { // Short variant carries no readings unless "Smart Home integrations" is enabled
+					sensorData.CO2PPM = float64((int(advData[11]) << 8) + int(advData[10]))
+					sensorData.TemperatureCelsius = float64((int(advData[13])<<8)+int(advData[12])) / 20
+					sensorData.PressurePascal = float64((int(advData[15])<<8)+int(advData[14])) * 10
+					sensorData.HumidityPercent = float64(advData[16])
+					sensorData.BatteryPercent = float64(advData[17])
 				}
-			} else if advDataLength >= 16 && advData[0] == byte(0x1A) && advData[1] == byte(0x18) { // ATC / https://github.com/atc1441/ATC_MiThermometer
-				sensorData.ID = int(advData[14])
-				sensorData.Model = "ATC"
-				sensorData.TemperatureCelcius = float64((int(advData[8])<<8)+int(advData[9])) / 10
-				sensorData.HumidityPercent = float64(advData[10])
-				sensorData.BatteryPercent = float64(advData[11])
+			} else if advDataLength == 26 && advData[0] == byte(0x4C) && advData[1] == byte(0x00) && advData[2] == byte(0x02) && advData[3] == byte(0x15) && tiltColor(advData[4:20]) != "" { // Tilt hydrometer (iBeacon) - https://kvurd.com/blog/tilt-hydrometer-ibeacon-data-format/
+				sensorData.Model = "Tilt"
+				sensorData.Color = tiltColor(advData[4:20])
+				sensorData.TemperatureCelsius = (float64((int(advData[20])<<8)+int(advData[21])) - 32) * 5 / 9 // Major is in fahrenheit
+				sensorData.SpecificGravity = float64((int(advData[22])<<8)+int(advData[23])) / 1000            // Minor is gravity * 1000
+			} else if advDataLength >= 15 && advData[0] == byte(0x33) && advData[1] == byte(0x01) && advData[2] == byte(0x17) { // BlueMaestro Tempo Disc THD (version 23) - https://www.bluemaestro.com/wp-content/uploads/2018/09/Tempo-Disc-Advertising-Packet-Format.pdf
+				sensorData.Model = "BlueMaestro"
+				sensorData.BatteryPercent = float64(advData[3])                                               // 4-7 are the logging interval and log count
+				sensorData.TemperatureCelsius = float64(int16(uint16(advData[8])<<8|uint16(advData[9]))) / 10 // Signed, big endian
+				sensorData.HumidityPercent = float64(int16(uint16(advData[10])<<8|uint16(advData[11]))) / 10
+				sensorData.DewPointCelsius = float64(int16(uint16(advData[12])<<8|uint16(advData[13]))) / 10
+			} else if advDataLength >= 3 && advData[0] == byte(0x4C) && advData[1] == byte(0x00) { // Apple continuity (nearby, AirPods, handoff, ...)
+				sensorData.Model = "AppleContinuity"
 			}
 		}
 		packetPointer = packetPointer + advDataLength + 1
@@ -239,26 +1040,138 @@ func parseAdvertisementReportData(a ble.Advertisement) (*SensorData, error) {
 	return sensorData, nil
 }
 
+var adTypeNames = map[int]string{ // https://www.bluetooth.com/specifications/assigned-numbers/ (Common Data Types)
+	0x01: "flags",
+	0x02: "incomplete_uuid16",
+	0x03: "complete_uuid16",
+	0x04: "incomplete_uuid32",
+	0x05: "complete_uuid32",
+	0x06: "incomplete_uuid128",
+	0x07: "complete_uuid128",
+	0x08: "shortened_name",
+	0x09: "complete_name",
+	0x0A: "tx_power",
+	0x16: "service_data_uuid16",
+	0x19: "appearance",
+	0x20: "service_data_uuid32",
+	0x21: "service_data_uuid128",
+	0xFF: "manufacturer",
+}
+
+func adTypeName(adType int) string {
+	if name, ok := adTypeNames[adType]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", adType)
+}
+
+var tiltColors = []string{"Red", "Green", "Black", "Purple", "Orange", "Blue", "Yellow", "Pink"}
+
+func tiltColor(uuid []byte) string { // Tilt UUIDs are A495BBx0-C5B1-4B44-B512-1370F02D74DE, where x is the color
+	tiltUUID := []byte{0xA4, 0x95, 0xBB, 0x00, 0xC5, 0xB1, 0x4B, 0x44, 0xB5, 0x12, 0x13, 0x70, 0xF0, 0x2D, 0x74, 0xDE}
+	for i := range tiltUUID {
+		if i != 3 && uuid[i] != tiltUUID[i] {
+			return ""
+		}
+	}
+	color := int(uuid[3] >> 4)
+	if uuid[3]&0x0F != 0 || color < 1 || color > len(tiltColors) {
+		return ""
+	}
+	return tiltColors[color-1]
+}
+
 func main() {
-	log.Printf("%s version %s (Rev: %s Branch: %s) built on %s", applicationName, BuildVersion, BuildRevision, BuildBranch, BuildTime)
+	logInfo("%s version %s (Rev: %s Branch: %s) built on %s", applicationName, BuildVersion, BuildRevision, BuildBranch, BuildTime)
 	parseFlags()
+	initDeviceLabels()
+	if len(flagLogFile) > 0 {
+		if err := openLogFile(); err != nil {
+			log.Fatalf("Failed to open log file %s - %v", flagLogFile, err)
+		}
+	}
+	configInfoMetricSet()
+	if len(flagPIDFile) > 0 || len(flagOTLPEndpoint) > 0 || len(flagDumpDevicesCSV) > 0 || len(flagMQTTBroker) > 0 {
+		deferCleanup() // This installs a handler to remove PID file, flush OTLP, disconnect MQTT and dump the devices when we quit
+	}
 	if len(flagPIDFile) > 0 {
-		deferCleanup() // This installs a handler to remove PID file when we quit
 		savePIDFile(flagPIDFile)
 	}
 	if len(flagMetricsListen) > 0 { // Start metrics engine
 		httpServerStart()
+		go heartbeat()
+	}
+	if len(flagOTLPEndpoint) > 0 { // Mirror the device gauges over OTLP
+		if err := otlpStart(); err != nil {
+			log.Fatalf("Failed to start OTLP exporter - %v", err)
+		}
+	}
+	if len(flagPushgatewayURL) > 0 { // Push metrics for prometheus servers that can't reach us
+		go pushPeriodically()
 	}
-	if len(flagNamesCSVFile) > 0 { // Load the names hint file
-		loadNamesCSVFile(flagNamesCSVFile)
+	if len(flagMQTTBroker) > 0 { // Publish readings over MQTT
+		mqttStart()
 	}
-	bluetoothScan()
-	log.Printf("quit")
+	if len(flagCapture) > 0 {
+		if err := openCaptureFile(); err != nil {
+			log.Fatalf("Failed to open -capture file - %v", err)
+		}
+	}
+	if len(flagFIFO) > 0 {
+		if err := createFIFO(); err != nil {
+			log.Fatalf("Failed to create -fifo - %v", err)
+		}
+	}
+	if len(flagNamesCSVFile) > 0 || len(configNames) > 0 { // Load the names hint file
+		reloadNames()
+	}
+	if len(flagNamesCSVFile) > 0 || len(flagLogFile) > 0 {
+		go reloadOnSIGHUP()
+	}
+	if len(flagCalibrationCSVFile) > 0 { // Load the calibration offsets
+		loadCalibrationCSVFile(flagCalibrationCSVFile)
+	}
+	go motionDecay()
+	go expireDevicesPeriodically()
+	if len(flagDumpDevicesCSV) > 0 {
+		go dumpDevicesCSVPeriodically()
+	}
+	if flagWorkers > 0 {
+		startWorkers(flagWorkers)
+	}
+	if flagRequireDeviceWithin > 0 {
+		go requireDevice()
+	}
+	if flagSummaryInterval > 0 {
+		go summaryLogPeriodically()
+	}
+	if flagTUI {
+		tuiStart()
+	}
+	if len(flagReplay) > 0 {
+		if err := replayFile(flagReplay); err != nil {
+			log.Fatalf("Failed to replay %s - %v", flagReplay, err)
+		}
+		if len(flagMetricsListen) > 0 {
+			logInfo("Replay done, serving metrics until interrupted")
+			select {}
+		}
+	} else if flagSimulate {
+		simulateScan()
+	} else {
+		bluetoothScan()
+	}
+	cleanup() // The scan can also end on its own (e.g. ble's own SIGINT handler)
+	logInfo("quit")
 }
 
 func deferCleanup() { // Installs a handler to perform clean up
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGPIPE)
+	c := make(chan os.Signal, 1)
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGINT}
+	if len(flagFIFO) == 0 { // Would quit whenever a -fifo reader goes away, those writes handle EPIPE themselves
+		signals = append(signals, syscall.SIGPIPE)
+	}
+	signal.Notify(c, signals...)
 	go func() {
 		<-c
 		cleanup()
@@ -270,21 +1183,186 @@ func cleanup() {
 	if len(flagPIDFile) > 0 {
 		os.Remove(flagPIDFile)
 	}
-	log.Printf("%s perform clean up on process end", applicationName)
+	otlpShutdown()
+	mqttDisconnect()
+	if len(flagDumpDevicesCSV) > 0 {
+		dumpDevicesCSV()
+	}
+	logInfo("%s perform clean up on process end", applicationName)
 
 }
 
 func parseFlags() {
 	flag.StringVar(&flagMetricsListen, "metrics-listen", "0.0.0.0:9978", "metrics listener <host>:<port>") // Recommend 0.0.0.0:9978
-	flag.StringVar(&flagAdapterID, "adapterID", "hci0", "hci0")                                            // Default to use hci0 (first bt device)
+	flag.StringVar(&flagAdapterID, "adapterID", "hci0", "hci0, or a comma separated list (hci0,hci1)")     // Default to use hci0 (first bt device)
+	flag.StringVar(&flagHTTPBasicAuth, "http-basic-auth", "", "<user>:<password> required by administrative http endpoints (e.g. /reload)")
+	flag.DurationVar(&flagRequireDeviceWithin, "require-device-within", 0, "exit with status 3 unless a supported device was decoded within this long after start (0 to disable)")
+	flag.BoolVar(&flagNoMetricsCompression, "no-metrics-compression", false, "never gzip /metrics, even when the scraper accepts it")
+	flag.BoolVar(&flagNoLandingPage, "no-landing-page", false, "don't serve the html landing page on /")
 	flag.StringVar(&flagPIDFile, "pidfile", "", "pidfile")
-	flag.StringVar(&flagNamesCSVFile, "names-csv", "", "namesfile")
-	flag.BoolVar(&flagVerbose, "verbose", false, "verbose flag")
-	flag.BoolVar(&flagDebug, "debug", false, "debug flag")
+	flag.StringVar(&flagLogFile, "logfile", "", "log to this file instead of stderr, reopened on SIGHUP")
+	flag.StringVar(&flagNamesCSVFile, "names-csv", "", "namesfile(s), comma separated and/or globs")
+	flag.StringVar(&flagConfig, "config", "", "yaml file with metrics-listen, adapterID, device-timeout, names and models, flags given on the command line win")
+	flag.StringVar(&flagMQTTBroker, "mqtt-broker", "", "publish readings to this MQTT broker (e.g. tcp://localhost:1883)")
+	flag.StringVar(&flagMQTTTopicPrefix, "mqtt-topic-prefix", applicationName, "MQTT readings are published to <prefix>/<mac>/state")
+	flag.StringVar(&flagMQTTUsername, "mqtt-username", "", "MQTT username")
+	flag.StringVar(&flagMQTTPassword, "mqtt-password", "", "MQTT password")
+	flag.BoolVar(&flagMQTTHADiscovery, "mqtt-ha-discovery", false, "announce devices to Home Assistant over MQTT discovery")
+	flag.StringVar(&flagMQTTHAPrefix, "mqtt-ha-prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+	flag.StringVar(&flagAlertRule, "alert-rule", "", "comma separated [<mac or name>/]<field><op><value> thresholds, e.g. temperature>-15")
+	flag.DurationVar(&flagAlertDebounce, "alert-debounce", 15*time.Minute, "fire a still breached -alert-rule again at most every interval")
+	flag.StringVar(&flagOnAlertCommand, "on-alert-command", "", "run this shell command when an -alert-rule fires, with BTLE_MAC, BTLE_NAME, BTLE_MODEL, BTLE_RULE, BTLE_FIELD and BTLE_VALUE set")
+	flag.BoolVar(&flagOnlyOnChange, "only-on-change", false, "only pass readings on to the history, MQTT and -json-stdout when a value changed by more than -change-epsilon")
+	flag.Float64Var(&flagChangeEpsilon, "change-epsilon", 0.05, "smallest change -only-on-change counts as a change")
+	flag.DurationVar(&flagDeviceTimeout, "device-timeout", 15*time.Minute, "devices not heard from for this long are considered gone (btle_exporter_device_up 0, readings dropped, gone from /stats, -tui and OTLP), long enough that sensors advertising every few minutes don't flap")
+	flag.DurationVar(&flagDeviceUpGrace, "device-up-grace", time.Hour, "how long btle_exporter_device_up stays at 0 for a silent device before it is removed")
+	flag.BoolVar(&flagExportUnknown, "export-unknown", false, "export signal, advertisement count and last seen of devices without a decoder, as model=\"unknown\"")
+	flag.BoolVar(&flagExportAdapterSeen, "export-adapter-seen", false, "export btle_exporter_device_adapter_seen{adapter} for every adapter that heard a device within -device-timeout")
+	flag.StringVar(&flagPushgatewayURL, "pushgateway-url", "", "push metrics to this Pushgateway (e.g. http://pushgateway:9091), for when prometheus can't scrape us")
+	flag.StringVar(&flagPushgatewayJob, "pushgateway-job", applicationName, "Pushgateway job name")
+	flag.DurationVar(&flagPushgatewayInterval, "pushgateway-interval", 30*time.Second, "interval between Pushgateway pushes")
+	flag.IntVar(&flagWorkers, "workers", 0, "process advertisements on this many worker goroutines, off the scan callback (0 to process inline)")
+	flag.StringVar(&flagRSSIAgg, "rssi-agg", "last", "signal reported for a device heard repeatedly within 10s: last, max (strongest) or avg")
+	flag.StringVar(&flagLocation, "location", "", "add a location label with this value to every device metric, to tell sites apart (none when empty)")
+	flag.StringVar(&flagSanitizeNames, "sanitize-names", "off", "clean up name label values: off, trim (trim and collapse whitespace) or underscore (trim, then spaces to underscores)")
+	flag.StringVar(&flagDumpDevicesCSV, "dump-devices-csv", "", "write every discovered device (mac,name,model) to this file every minute and on exit, as a -names-csv seed")
+	flag.StringVar(&flagCalibrationCSVFile, "calibration-csv", "", "calibrationfile")
+	flag.DurationVar(&flagHeartbeatInterval, "heartbeat-interval", 5*time.Second, "heartbeat metric refresh interval")
+	flag.DurationVar(&flagAverageWindow, "average-window", 0, "export the mean of each device's temperature, humidity, pressure, CO2, VOC and dew point over this window (e.g. 5m), 0 exports every reading as is")
+	flag.DurationVar(&flagSampleInterval, "sample-interval", 0, "process each device at most once per interval (0 to process every advertisement)")
+	flag.BoolVar(&flagAllowDuplicates, "allow-duplicates", true, "report every advertisement, not just the first per device per scan")
+	flag.DurationVar(&flagStartupGrace, "startup-grace", 30*time.Second, "time after start during which health checks pass and nothing is expired")
+	flag.DurationVar(&flagHealthTimeout, "health-timeout", 60*time.Second, "/healthz fails when no advertisement was seen for this long")
+	flag.IntVar(&flagHistorySize, "history-size", 20, "number of recent readings kept per device for /devices/<mac>/history (0 to disable)")
+	flag.IntVar(&flagMinAdvCount, "min-adv-count", 1, "only export a device once it was heard this many times, without gaps longer than -min-adv-window")
+	flag.DurationVar(&flagNoDataRestart, "no-data-restart", 0, "restart the scan, reopening the adapter, when it delivered no advertisements for this long (e.g. 5m), 0 never does")
+	flag.DurationVar(&flagDedupWindow, "dedup-window", 0, "skip byte identical advertisements from a device within this long of the last one processed (e.g. 100ms for the 3 advertising channels), 0 processes all")
+	flag.DurationVar(&flagMinAdvWindow, "min-adv-window", 5*time.Minute, "longest gap between advertisements still counted towards -min-adv-count")
+	flag.DurationVar(&flagRediscoverAfter, "rediscover-after", time.Hour, "log a known device as discovered again only after it was silent this long")
+	flag.StringVar(&flagGATTPoll, "gatt-poll", "", "comma separated macs of non-broadcasting sensors (Mi Flora, stock LYWSD03MMC) to connect to and read")
+	flag.DurationVar(&flagGATTPollInterval, "gatt-poll-interval", 5*time.Minute, "interval between GATT polls of each -gatt-poll device")
+	flag.StringVar(&flagOTLPEndpoint, "otlp-endpoint", "", "push metrics over OTLP/http to this collector (host:port or url), disabled if empty")
+	flag.DurationVar(&flagOTLPInterval, "otlp-interval", 30*time.Second, "interval between OTLP metric pushes")
+	flag.DurationVar(&flagSummaryInterval, "summary-interval", 0, "log a summary of active devices by model every interval (0 to disable)")
+	flag.DurationVar(&flagMotionTimeout, "motion-timeout", 60*time.Second, "time after the last detection before motion reports 0 again")
+	flag.Float64Var(&flagRoundTemperature, "round-temperature", 0, "round temperatures to a multiple of this (e.g. 0.5), 0 keeps full precision")
+	flag.Float64Var(&flagRoundHumidity, "round-humidity", 0, "round humidity to a multiple of this (e.g. 1), 0 keeps full precision")
+	flag.Float64Var(&flagTemperatureMin, "temperature-min", -40, "lowest plausible temperature, lower readings are dropped")
+	flag.Float64Var(&flagTemperatureMax, "temperature-max", 85, "highest plausible temperature, higher readings are dropped")
+	flag.Float64Var(&flagBatteryMin, "battery-min", 0, "lowest plausible battery percent, lower readings are dropped (e.g. 1 for sensors that glitch to 0%), as are 255 (unknown) and above 100")
+	flag.StringVar(&flagReplay, "replay", "", "decode the advertisements in this capture file instead of scanning, then keep serving metrics")
+	flag.StringVar(&flagDecoderScale, "decoder-scale", "", "comma separated <model>.<tempScale|humidityScale>=<factor> overrides of decoder scaling, e.g. ATC.tempScale=0.01")
+	flag.StringVar(&flagBatteryCurve, "battery-curve", "", "comma separated <volts>=<percent> points replacing the CR2032 curve for sensors that only report battery voltage, e.g. 3.2=100,2.9=50,2.5=0")
+	flag.StringVar(&flagExternalDecoder, "external-decoder", "", "shell command decoding the advertisements no built-in decoder understands, a \"<mac> <rssi> <hex>\" line in on stdin, a json reading line out on stdout")
+	flag.DurationVar(&flagExternalDecoderTimeout, "external-decoder-timeout", 500*time.Millisecond, "how long -external-decoder gets to answer, before it's killed and restarted")
+	flag.StringVar(&flagCapture, "capture", "", "append every advertisement heard to this file, in the -replay format")
+	flag.Int64Var(&flagCaptureMaxSize, "capture-max-size", 100<<20, "rotate the -capture file to <file>.1 at this many bytes (0 for no limit)")
+	flag.BoolVar(&flagSimulate, "simulate", false, "feed synthetic advertisements instead of scanning (no adapter needed)")
+	flag.IntVar(&flagMinRSSI, "min-rssi", 0, "drop advertisements weaker than this rssi (e.g. -90), 0 keeps all")
+	flag.IntVar(&flagMinPayloadLength, "min-payload-length", 0, "drop advertisements with fewer payload bytes than this before parsing, 0 keeps all")
+	flag.StringVar(&flagMacAllow, "mac-allow", "", "comma separated macs, when set only these are processed")
+	flag.StringVar(&flagMacDeny, "mac-deny", "", "comma separated macs that are never processed")
+	flag.StringVar(&flagSkipCompanyIDs, "skip-company-ids", "", "comma separated manufacturer data company ids (e.g. 0x0006) whose advertisements are skipped without decoding")
+	flag.BoolVar(&flagTUI, "tui", false, "show a live updating table of the active devices instead of log lines (needs a terminal)")
+	flag.BoolVar(&flagJSONStdout, "json-stdout", false, "print every decoded reading as a json line to stdout")
+	flag.StringVar(&flagFIFO, "fifo", "", "write every decoded reading as a json line to this named pipe (created if missing), dropped while no reader is attached")
+	flag.StringVar(&flagLogLevel, "log-level", "", "error, warn, info, debug or trace (default info, or what -verbose/-debug map to)")
+	flag.BoolVar(&flagVerbose, "verbose", false, "same as -log-level debug")
+	flag.BoolVar(&flagDebug, "debug", false, "same as -log-level trace")
 	flag.BoolVar(&flagVersion, "version", false, "get version")
 	flag.Parse()
-	if flagDebug {
-		flagVerbose = true // Its confusing if flagDebug is on, but flagVerbose isn't
+	if len(flagConfig) > 0 {
+		config, err := loadConfig(flagConfig)
+		if err != nil {
+			log.Fatalf("Bad -config %s - %v", flagConfig, err)
+		}
+		if err := applyConfig(flag.CommandLine, config); err != nil {
+			log.Fatalf("Bad -config %s - %v", flagConfig, err)
+		}
+	}
+	level := levelInfo
+	if len(flagLogLevel) > 0 {
+		var err error
+		if level, err = parseLogLevel(flagLogLevel); err != nil {
+			log.Fatalf("Bad -log-level - %v", err)
+		}
+	} else if flagDebug {
+		level = levelTrace
+	} else if flagVerbose {
+		level = levelDebug
+	}
+	setLogLevel(level)
+	for _, id := range strings.Split(flagSkipCompanyIDs, ",") {
+		if id = strings.TrimSpace(id); len(id) == 0 {
+			continue
+		}
+		companyID, err := strconv.ParseUint(id, 0, 16)
+		if err != nil {
+			log.Fatalf("Bad -skip-company-ids entry %q - %v", id, err)
+		}
+		skipCompanyIDs[uint16(companyID)] = true
+	}
+	if flagTUI && flagJSONStdout {
+		log.Fatalf("-tui and -json-stdout both want stdout, pick one")
+	}
+	for _, override := range strings.Split(flagDecoderScale, ",") {
+		if override = strings.TrimSpace(override); len(override) == 0 {
+			continue
+		}
+		key, value, _ := strings.Cut(override, "=")
+		factor, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Fatalf("Bad -decoder-scale entry %q - %v", override, err)
+		}
+		if err := decoders.SetScale(key, factor); err != nil {
+			log.Fatalf("Bad -decoder-scale entry %q - %v", override, err)
+		}
+		logInfo("Scaling %s by %g", key, factor)
+	}
+	var err error
+	if macAllowSet, err = parseMacSet(flagMacAllow); err != nil {
+		log.Fatalf("Bad -mac-allow - %v", err)
+	}
+	if macDenySet, err = parseMacSet(flagMacDeny); err != nil {
+		log.Fatalf("Bad -mac-deny - %v", err)
+	}
+	if len(flagBatteryCurve) > 0 {
+		if err := decoders.SetBatteryCurve(flagBatteryCurve); err != nil {
+			log.Fatalf("Bad -battery-curve - %v", err)
+		}
+	}
+	if alertRules, err = parseAlertRules(flagAlertRule); err != nil {
+		log.Fatalf("Bad -alert-rule - %v", err)
+	}
+	if len(flagOnAlertCommand) > 0 && len(alertRules) == 0 {
+		log.Fatalf("-on-alert-command needs at least one -alert-rule")
+	}
+	if flagExternalDecoderTimeout <= 0 {
+		log.Fatalf("Bad -external-decoder-timeout %s, must be positive", flagExternalDecoderTimeout)
+	}
+	if flagAverageWindow < 0 {
+		log.Fatalf("Bad -average-window %s, must not be negative", flagAverageWindow)
+	}
+	if flagNoDataRestart < 0 || (flagNoDataRestart > 0 && flagNoDataRestart < time.Second) {
+		log.Fatalf("Bad -no-data-restart %s, must be 0 or at least 1s", flagNoDataRestart)
+	}
+	if flagDeviceTimeout <= 0 {
+		log.Fatalf("Bad -device-timeout %s, must be positive", flagDeviceTimeout)
+	}
+	if flagWorkers < 0 {
+		log.Fatalf("Bad -workers %d, must be 0 or more", flagWorkers)
+	}
+	if flagRSSIAgg != "last" && flagRSSIAgg != "max" && flagRSSIAgg != "avg" {
+		log.Fatalf("Bad -rssi-agg %q, expected last, max or avg", flagRSSIAgg)
+	}
+	if flagSanitizeNames != "off" && flagSanitizeNames != "trim" && flagSanitizeNames != "underscore" {
+		log.Fatalf("Bad -sanitize-names %q, expected off, trim or underscore", flagSanitizeNames)
+	}
+	if flagHeartbeatInterval <= 0 {
+		log.Fatalf("Bad -heartbeat-interval %s, must be positive", flagHeartbeatInterval)
+	}
+	if len(flagPushgatewayURL) > 0 && flagPushgatewayInterval <= 0 {
+		log.Fatalf("Bad -pushgateway-interval %s, must be positive", flagPushgatewayInterval)
 	}
 	if flagVersion { // Only print version (We always print version), then exit.
 		os.Exit(0)
@@ -301,52 +1379,341 @@ func savePIDFile(pidFile string) {
 	if _, err = file.WriteString(strconv.Itoa(pid)); err != nil {
 		log.Fatalf("Unable to create pid file : %v", err)
 	}
-	if flagVerbose {
-		log.Printf("Wrote PID %0d to %s", pid, flagPIDFile)
-	}
+	logDebug("Wrote PID %0d to %s", pid, flagPIDFile)
 	file.Sync() // flush to disk
 }
 
-func loadNamesCSVFile(namesFile string) {
+func loadNamesCSVFile(namesFile string) (map[string]string, error) {
 	f, err := os.Open(namesFile)
 	if err != nil {
-		log.Printf("Failed to open %s - %v", namesFile, err)
+		logWarn("Failed to open %s - %v", namesFile, err)
+		return nil, err
+	}
+	defer f.Close() // this needs to be after the err check
+
+	csvLines, err := newCSVReader(f).ReadAll()
+	if err != nil {
+		logWarn("Failed to parse %s - %v", namesFile, err)
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, line := range csvLines {
+		mac := strings.ToLower(strings.TrimSpace(line[0])) // .Addr always returns lower case
+		if len(line) < 2 || len(mac) == 0 {                // Blank or whitespace only lines
+			continue
+		}
+		names[mac] = line[1]
+	}
+	logInfo("Loaded %0d lines from csv file %s", len(names), namesFile)
+	return names, nil
+}
+
+func newCSVReader(r io.Reader) *csv.Reader { // Tolerates the UTF-8 BOM of Windows exported files, and ragged lines
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && bytes.Equal(bom, []byte{0xEF, 0xBB, 0xBF}) {
+		br.Discard(3)
+	}
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+func namesCSVFiles() []string { // -names-csv takes a comma separated list of files and/or globs
+	var files []string
+	for _, pattern := range strings.Split(flagNamesCSVFile, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 {
+			continue
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			files = append(files, pattern) // Plain file, let the open fail and report it
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			logWarn("Skipping bad names csv glob %s - %v", pattern, err)
+			continue
+		}
+		if len(matches) == 0 {
+			logWarn("Names csv glob %s matches no files", pattern)
+		}
+		files = append(files, matches...)
+	}
+	return files
+}
+
+func reloadNames() (int, error) { // Swaps in a freshly loaded namesMap, shared by startup, SIGHUP and POST /reload
+	names := make(map[string]string)
+	for mac, name := range configNames { // The csv files override them
+		names[mac] = name
+	}
+	files := namesCSVFiles()
+	failed := 0
+	var lastErr error
+	for _, namesFile := range files {
+		fileNames, err := loadNamesCSVFile(namesFile) // Logs its own failure
+		if err != nil {
+			failed++
+			lastErr = err
+			continue // One bad file shouldn't cost us the names from the others
+		}
+		for mac, name := range fileNames { // Later files override earlier ones
+			if previous, ok := names[mac]; ok && previous != name {
+				logWarn("Name for %s from %s (%s) overrides earlier name (%s)", mac, namesFile, name, previous)
+			}
+			names[mac] = name
+		}
+	}
+	if failed > 0 && failed == len(files) {
+		return 0, lastErr // Keep the names we have
+	}
+	namesMutex.Lock()
+	namesMap = names
+	namesMutex.Unlock()
+	return len(names), nil
+}
+
+func reloadOnSIGHUP() { // Reopens -logfile (for logrotate) and reloads the names csv files
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if len(flagLogFile) > 0 {
+			reopenLogFile()
+		}
+		if len(flagNamesCSVFile) > 0 {
+			logInfo("SIGHUP received, reloading %s", flagNamesCSVFile)
+			reloadNames()
+		}
+	}
+}
+
+func loadCalibrationCSVFile(calibrationFile string) {
+	f, err := os.Open(calibrationFile)
+	if err != nil {
+		logWarn("Failed to open %s - %v", calibrationFile, err)
 		return
 	}
 	defer f.Close() // this needs to be after the err check
 
-	csvLines, err := csv.NewReader(f).ReadAll()
+	csvLines, err := newCSVReader(f).ReadAll()
 	if err != nil {
-		log.Printf("Failed to parse %s - %v", namesFile, err)
+		logWarn("Failed to parse %s - %v", calibrationFile, err)
 		return
 	}
-	count := 0
+	calibrations := make(map[string]calibration)
 	for _, line := range csvLines {
-		namesMap[strings.ToLower(line[0])] = line[1] // .Addr always returns lower case
-		count++
+		if len(line) < 3 {
+			logWarn("Skipping calibration line %q - expected <mac or model>,<temp_offset>,<humidity_offset>", strings.Join(line, ","))
+			continue
+		}
+		temperatureOffset, err := strconv.ParseFloat(strings.TrimSpace(line[1]), 64)
+		if err != nil {
+			logWarn("Skipping calibration for %s - bad temperature offset : %v", line[0], err)
+			continue
+		}
+		humidityOffset, err := strconv.ParseFloat(strings.TrimSpace(line[2]), 64)
+		if err != nil {
+			logWarn("Skipping calibration for %s - bad humidity offset : %v", line[0], err)
+			continue
+		}
+		calibrations[strings.ToLower(line[0])] = calibration{TemperatureOffset: temperatureOffset, HumidityOffset: humidityOffset} // .Addr always returns lower case
 	}
-	log.Printf("Loaded %0d lines from csv file %s", count, namesFile)
+	calibrationMutex.Lock()
+	calibrationMap = calibrations
+	calibrationMutex.Unlock()
+	logInfo("Loaded %0d lines from calibration csv file %s", len(calibrations), calibrationFile)
 }
 
-func getMacName(mac string) string { // Converts a mac adress to a name
+func applyCalibration(mac string, sensorData *SensorData) { // MAC offsets take priority over model offsets
+	calibrationMutex.RLock()
+	defer calibrationMutex.RUnlock()
+	c, ok := calibrationMap[mac]
+	if !ok {
+		if c, ok = calibrationMap[strings.ToLower(sensorData.Model)]; !ok {
+			return
+		}
+	}
+	if sensorData.TemperatureCelsius != undefined {
+		sensorData.TemperatureCelsius += c.TemperatureOffset
+	}
+	if sensorData.HumidityPercent != undefined {
+		sensorData.HumidityPercent += c.HumidityOffset
+	}
+}
+
+func roundTo(value float64, step float64) float64 {
+	if step <= 0 || value == undefined {
+		return value
+	}
+	return math.Round(value/step) * step
+}
+
+func roundReadings(sensorData *SensorData) { // Opt-in coarser precision, for quieter graphs and less TSDB churn
+	sensorData.TemperatureCelsius = roundTo(sensorData.TemperatureCelsius, flagRoundTemperature)
+	sensorData.HumidityPercent = roundTo(sensorData.HumidityPercent, flagRoundHumidity)
+}
+
+func rejectImplausibleReadings(sensorData *SensorData) { // Corrupt frames can pass length checks, drop what can't be real
+	if sensorData.HumidityPercent != undefined && (sensorData.HumidityPercent < 0 || sensorData.HumidityPercent > 100) {
+		metricsReadingRejectedCount.With(prometheus.Labels{"reason": "humidity_out_of_range"}).Inc()
+		sensorData.HumidityPercent = undefined
+	}
+	if sensorData.TemperatureCelsius != undefined && (sensorData.TemperatureCelsius < flagTemperatureMin || sensorData.TemperatureCelsius > flagTemperatureMax) {
+		metricsReadingRejectedCount.With(prometheus.Labels{"reason": "temperature_out_of_range"}).Inc()
+		sensorData.TemperatureCelsius = undefined
+	}
+	if sensorData.BatteryPercent == 255 { // The usual "not available" value of a battery byte
+		metricsReadingRejectedCount.With(prometheus.Labels{"reason": "battery_unknown"}).Inc()
+		sensorData.BatteryPercent = undefined
+	} else if sensorData.BatteryPercent != undefined && (sensorData.BatteryPercent < flagBatteryMin || sensorData.BatteryPercent > 100) {
+		metricsReadingRejectedCount.With(prometheus.Labels{"reason": "battery_out_of_range"}).Inc()
+		sensorData.BatteryPercent = undefined
+	}
+}
+
+func getMacName(mac string) string { // Converts a mac adress to a name, sanitized for use as a label
+	return sanitizeName(rawMacName(mac))
+}
+
+func rawMacName(mac string) string { // The name exactly as given in the names csv file
+	namesMutex.RLock()
+	defer namesMutex.RUnlock()
 	return namesMap[mac]
 }
 
+func sanitizeName(name string) string {
+	switch flagSanitizeNames {
+	case "trim": // Trim and collapse whitespace
+		return strings.Join(strings.Fields(name), " ")
+	case "underscore": // And replace the remaining spaces
+		return strings.Join(strings.Fields(name), "_")
+	}
+	return name
+}
+
+func configInfoMetricSet() { // Exposes the effective runtime configuration, so remote exporters can be audited
+	var configInfoMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "btle_exporter_config_info", Help: "Shows the effective runtime configuration",
+		ConstLabels: prometheus.Labels{
+			"adapter":            flagAdapterID,
+			"names_csv":          flagNamesCSVFile,
+			"heartbeat_interval": flagHeartbeatInterval.String(),
+			"sample_interval":    flagSampleInterval.String(),
+			"device_timeout":     flagDeviceTimeout.String(),
+			"rssi_min":           strconv.Itoa(flagMinRSSI),
+			"allow_duplicates":   strconv.FormatBool(flagAllowDuplicates),
+			"temperature_range":  fmt.Sprintf("%g..%g", flagTemperatureMin, flagTemperatureMax),
+			"verbose":            strconv.FormatBool(flagVerbose),
+			"debug":              strconv.FormatBool(flagDebug),
+			"log_level":          logLevelNames[currentLogLevel],
+			"location":           flagLocation,
+		}})
+	prometheus.MustRegister(configInfoMetric)
+	configInfoMetric.Set(1)
+}
+
+func heartbeat() { // Keeps a metric moving so "alive but no beacons" can be told apart from "dead"
+	ticker := time.NewTicker(flagHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		metricsHeartbeatGauge.Set(float64(time.Now().Unix()))
+		<-ticker.C
+	}
+}
+
+func requireDevice() { // Turns "running, but hears nothing" into a failed deploy smoke test
+	time.Sleep(flagRequireDeviceWithin)
+	if currentStats().Totals.Decoded > 0 {
+		return
+	}
+	logError("No supported device decoded within -require-device-within %s, check the adapter (-adapterID) and that the sensors are in range", flagRequireDeviceWithin)
+	cleanup()
+	os.Exit(exitNoDevice)
+}
+
+func inStartupGrace() bool { // Gives the adapter time to warm up before anything judges the absence of advertisements
+	return time.Since(startTime) < flagStartupGrace
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	age := time.Since(time.Unix(atomic.LoadInt64(&lastAdvertisementTime), 0))
+	if !inStartupGrace() && age > flagHealthTimeout {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "no advertisements for %s\n", age.Truncate(time.Second))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func basicAuth(h http.HandlerFunc) http.HandlerFunc { // Guards administrative endpoints when -http-basic-auth is set
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(flagHTTPBasicAuth) > 0 {
+			user, password, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(flagHTTPBasicAuth)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+applicationName+`"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) { // POST /reload re-reads the names csv file
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(flagNamesCSVFile) == 0 {
+		http.Error(w, "no -names-csv configured", http.StatusNotFound)
+		return
+	}
+	count, err := reloadNames()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"entries": count})
+}
+
 func httpServerStart() {
 	var buildInfoMetric = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "blte_exporter_build_info", Help: "Shows the build info/version",
+		Name: "btle_exporter_build_info", Help: "Shows the build info/version",
 		ConstLabels: prometheus.Labels{"branch": BuildBranch, "revision": BuildRevision, "version": BuildVersion, "buildTime": BuildTime, "goversion": runtime.Version()}})
 	prometheus.MustRegister(buildInfoMetric)
 	buildInfoMetric.Set(1)
-	http.Handle("/metrics", promhttp.Handler()) // Do we really want this ?
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte("<html><body><a href=/metrics>metrics</a></body></html>"))
-	})
+	mux := http.NewServeMux() // Private mux, so nothing registered on http.DefaultServeMux (e.g. pprof) gets exposed
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		ErrorLog:           log.Default(),
+		ErrorHandling:      promhttp.ContinueOnError, // A broken collector shouldn't hide every other metric
+		DisableCompression: flagNoMetricsCompression, // Otherwise gzip whenever the scraper accepts it
+	})))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/devices", basicAuth(devicesHandler))
+	mux.HandleFunc("/devices/", basicAuth(deviceHistoryHandler))
+	mux.HandleFunc("/reload", basicAuth(reloadHandler))
+	mux.HandleFunc("/stats", basicAuth(statsHandler))
+	mux.HandleFunc("/filtered", basicAuth(filteredHandler))
+	if !flagNoLandingPage {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body><a href=/metrics>metrics</a></body></html>"))
+		})
+	}
+	server := &http.Server{
+		Addr:              flagMetricsListen,
+		Handler:           mux,
+		ReadHeaderTimeout: httpReadTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
 	go func() {
-		if err := http.ListenAndServe(flagMetricsListen, nil); err != nil {
+		if err := server.ListenAndServe(); err != nil {
 			log.Fatalf("FATAL: Failed to start metrics http engine - %v", err)
 		}
 	}()
-	log.Printf("%s metrics engine listening on %s", applicationName, flagMetricsListen)
+	logInfo("%s metrics engine listening on %s", applicationName, flagMetricsListen)
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSharedMapsConcurrentAccess(t *testing.T) { // Run with -race
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				fixture := simulatedFixtures[i%len(simulatedFixtures)]
+				data, _ := hex.DecodeString(fixture.data)
+				mac := fmt.Sprintf("aa:bb:cc:00:%02x:%02x", g, i%16)
+				advScanHandler(&simulatedAdvertisement{addr: mac, rssi: -60, data: data})
+				getMacName(mac)
+				sampleDue(mac)
+				deviceHistoryHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/devices/"+mac+"/history", nil))
+				devicesHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/devices", nil))
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			namesMutex.Lock()
+			namesMap = map[string]string{"aa:bb:cc:00:00:00": "hammered"}
+			namesMutex.Unlock()
+			expireDevices(time.Now())
+		}
+	}()
+	wg.Wait()
+}
+
+func TestAggregateRSSI(t *testing.T) {
+	defer func(agg string) { flagRSSIAgg = agg }(flagRSSIAgg)
+	for _, tc := range []struct {
+		agg  string
+		want []int
+	}{
+		{"last", []int{-70, -60, -80}},
+		{"max", []int{-70, -60, -60}},
+		{"avg", []int{-70, -65, -70}},
+	} {
+		flagRSSIAgg = tc.agg
+		mac := "aa:bb:cc:dd:ee:" + tc.agg
+		for i, rssi := range []int{-70, -60, -80} {
+			if got := aggregateRSSI(mac, rssi); got != tc.want[i] {
+				t.Errorf("%s, advertisement %d : got %d, want %d", tc.agg, i+1, got, tc.want[i])
+			}
+		}
+	}
+	expireRSSI(time.Now().Add(rssiAggWindow + time.Second))
+	rssiMutex.RLock()
+	_, tracked := rssiMap["aa:bb:cc:dd:ee:max"]
+	rssiMutex.RUnlock()
+	if tracked {
+		t.Errorf("window over : still in rssiMap")
+	}
+}
+
+func TestHeardEnough(t *testing.T) {
+	defer func(count int, window time.Duration) { flagMinAdvCount, flagMinAdvWindow = count, window }(flagMinAdvCount, flagMinAdvWindow)
+	flagMinAdvCount, flagMinAdvWindow = 3, time.Minute
+	mac := "aa:bb:cc:dd:ee:01"
+	for i, want := range []bool{false, false, true, true} {
+		if got := heardEnough(mac); got != want {
+			t.Errorf("advertisement %d : got %v, want %v", i+1, got, want)
+		}
+	}
+	heardMutex.Lock()
+	heardMap[mac].last = heardMap[mac].last.Add(-2 * flagMinAdvWindow) // Gone quiet, counting starts over
+	heardMutex.Unlock()
+	if heardEnough(mac) {
+		t.Errorf("after a gap : got true, want false")
+	}
+}
+
+func TestReadingChanged(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	mac := "aa:bb:cc:dd:ee:20"
+	for i, step := range []struct {
+		temperature, humidity *float64
+		changed               bool
+	}{
+		{value(20), nil, true},
+		{value(20.04), nil, false},       // Within epsilon
+		{nil, value(50), true},           // First humidity
+		{value(20.03), value(50), false}, // Compared with what was propagated, not the last frame
+		{value(20.06), nil, true},        // Drifted past epsilon since propagated
+	} {
+		reading := &deviceReading{Mac: mac, Model: "LYWSDCGQ", TemperatureCelsius: step.temperature, HumidityPercent: step.humidity}
+		if got := readingChanged(reading, 0.05); got != step.changed {
+			t.Errorf("step %d : got changed %v, want %v", i, got, step.changed)
+		}
+	}
+}
+
+func TestUnknownBatteryNotExported(t *testing.T) {
+	defer func(min, max float64) { flagTemperatureMin, flagTemperatureMax = min, max }(flagTemperatureMin, flagTemperatureMax)
+	flagTemperatureMin, flagTemperatureMax = -40, 85
+	mac := "a4:c1:38:00:00:64"
+	data, _ := hex.DecodeString("02010610161a18a4c13800006400f43cff0bb80a") // ATC 24.4C 60%, battery 0xFF
+	rejected := testutil.ToFloat64(metricsReadingRejectedCount.With(prometheus.Labels{"reason": "battery_unknown"}))
+	advScanHandler(&simulatedAdvertisement{addr: mac, rssi: -60, data: data})
+	labels := deviceLabels(mac, getMacName(mac), "ATC")
+	if got := testutil.ToFloat64(metricsDeviceHumidityGauge.vecs[0].With(labels)); got != 60 {
+		t.Errorf("got humidity %g, want 60", got)
+	}
+	metricsDeviceBatteryGauge.register()
+	if metricsDeviceBatteryGauge.vecs[0].Delete(labels) {
+		t.Errorf("battery series exported for a 0xFF battery byte")
+	}
+	if got := testutil.ToFloat64(metricsReadingRejectedCount.With(prometheus.Labels{"reason": "battery_unknown"})) - rejected; got != 1 {
+		t.Errorf("counted %g unknown battery readings, want 1", got)
+	}
+}
+
+func TestExpireDevices(t *testing.T) {
+	defer func(timeout, grace time.Duration) { flagDeviceTimeout, flagDeviceUpGrace = timeout, grace }(flagDeviceTimeout, flagDeviceUpGrace)
+	flagDeviceTimeout, flagDeviceUpGrace = 15*time.Minute, time.Hour
+	mac := "aa:bb:cc:dd:ee:30"
+	labels := prometheus.Labels{"mac": mac, "name": "", "model": "ATC"}
+	markDeviceUp(mac, labels)
+	metricsDeviceTemperatureGauge.Set(labels, 21.5)
+	recordDevice(&deviceReading{Mac: mac, Model: "ATC"})
+	timeOutMutex.Lock()
+	timeOutMap[mac] = time.Now().Unix()
+	timeOutMutex.Unlock()
+	up := func() float64 { return testutil.ToFloat64(metricsDeviceUpGauge.vecs[0].With(labels)) }
+	now := time.Now()
+	expireDevices(now.Add(time.Minute))
+	if got := up(); got != 1 {
+		t.Errorf("fresh : got up %g, want 1", got)
+	}
+	expireDevices(now.Add(flagDeviceTimeout + time.Minute))
+	if got := up(); got != 0 {
+		t.Errorf("timed out : got up %g, want 0", got)
+	}
+	if metricsDeviceTemperatureGauge.vecs[0].Delete(labels) {
+		t.Errorf("timed out : temperature series still present")
+	}
+	timeOutMutex.RLock()
+	_, tracked := timeOutMap[mac]
+	timeOutMutex.RUnlock()
+	if tracked {
+		t.Errorf("timed out : still in timeOutMap")
+	}
+	deviceMutex.RLock()
+	_, tracked = deviceMap[mac]
+	deviceMutex.RUnlock()
+	if tracked {
+		t.Errorf("timed out : still in deviceMap")
+	}
+	expireDevices(now.Add(flagDeviceTimeout + flagDeviceUpGrace + time.Minute))
+	upMutex.RLock()
+	_, tracked = upMap[mac]
+	upMutex.RUnlock()
+	if tracked || metricsDeviceUpGauge.vecs[0].Delete(labels) {
+		t.Errorf("after the grace : series still present")
+	}
+}
+
+func TestRenamedDeviceDropsOldSeries(t *testing.T) {
+	mac := "aa:bb:cc:dd:ee:34"
+	before := prometheus.Labels{"mac": mac, "name": "shed", "model": "ATC"}
+	after := prometheus.Labels{"mac": mac, "name": "garage", "model": "ATC"}
+	metricsDeviceTemperatureGauge.Set(before, 21.5)
+	markDeviceUp(mac, before)
+	metricsDeviceTemperatureGauge.Set(after, 21.5)
+	markDeviceUp(mac, after)
+	if metricsDeviceTemperatureGauge.vecs[0].Delete(before) || metricsDeviceUpGauge.vecs[0].Delete(before) {
+		t.Errorf("series under the old name still present")
+	}
+	if !metricsDeviceTemperatureGauge.vecs[0].Delete(after) {
+		t.Errorf("series under the new name missing")
+	}
+}
+
+func TestOldestDeviceAge(t *testing.T) {
+	defer func(timeout time.Duration) { flagDeviceTimeout = timeout }(flagDeviceTimeout)
+	flagDeviceTimeout = 15 * time.Minute
+	now := time.Now().Truncate(time.Second) // timeOutMap holds unix seconds
+	timeOutMutex.Lock()
+	saved := timeOutMap
+	timeOutMap = map[string]int64{
+		"aa:bb:cc:dd:ee:31": now.Add(-time.Minute).Unix(),
+		"aa:bb:cc:dd:ee:32": now.Add(-10 * time.Minute).Unix(),
+		"aa:bb:cc:dd:ee:33": now.Add(-time.Hour).Unix(), // Gone, doesn't count
+	}
+	timeOutMutex.Unlock()
+	defer func() {
+		timeOutMutex.Lock()
+		timeOutMap = saved
+		timeOutMutex.Unlock()
+	}()
+	if got := oldestDeviceAge(now); got != 10*time.Minute {
+		t.Errorf("got %s, want 10m", got)
+	}
+}
+
+func TestDuplicateFrame(t *testing.T) {
+	defer func(window time.Duration) { flagDedupWindow = window }(flagDedupWindow)
+	flagDedupWindow = 100 * time.Millisecond
+	mac := "aa:bb:cc:dd:ee:50"
+	now := time.Now()
+	for i, step := range []struct {
+		payload   string
+		after     time.Duration
+		duplicate bool
+	}{
+		{"020106", 0, false},
+		{"020106", 5 * time.Millisecond, true}, // Same frame on another channel
+		{"020107", 10 * time.Millisecond, false},
+		{"020107", 60 * time.Millisecond, true},
+		{"020107", 150 * time.Millisecond, false}, // Window over, the steady reading is processed again
+	} {
+		if got := duplicateFrame(mac, []byte(step.payload), now.Add(step.after)); got != step.duplicate {
+			t.Errorf("step %d : got duplicate %v, want %v", i, got, step.duplicate)
+		}
+	}
+}
+
+func TestDevicesHandler(t *testing.T) {
+	defer func(timeout time.Duration) { flagDeviceTimeout = timeout }(flagDeviceTimeout)
+	flagDeviceTimeout = time.Minute
+	temperature, battery := 21.5, 87.0
+	recordDevice(&deviceReading{Mac: "aa:bb:cc:dd:ee:10", Name: "bedroom", Model: "LYWSD03MMC", LastSeen: 1700000000, TemperatureCelsius: &temperature})
+	merged := recordDevice(&deviceReading{Mac: "aa:bb:cc:dd:ee:10", Name: "bedroom", Model: "LYWSD03MMC", LastSeen: 1700000010, BatteryPercent: &battery})
+	if merged.TemperatureCelsius == nil || merged.BatteryPercent == nil { // As published to MQTT
+		t.Errorf("recordDevice : got %v %v, want the temperature and battery merged", merged.TemperatureCelsius, merged.BatteryPercent)
+	}
+	w := httptest.NewRecorder()
+	devicesHandler(w, httptest.NewRequest("GET", "/devices", nil))
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type : got %q, want application/json", got)
+	}
+	var readings []deviceReading
+	if err := json.Unmarshal(w.Body.Bytes(), &readings); err != nil {
+		t.Fatalf("decoding %q : %v", w.Body.String(), err)
+	}
+	for _, reading := range readings {
+		if reading.Mac != "aa:bb:cc:dd:ee:10" {
+			continue
+		}
+		if reading.Name != "bedroom" || reading.Model != "LYWSD03MMC" || reading.LastSeen != 1700000010 {
+			t.Errorf("got %s %s %d, want bedroom LYWSD03MMC 1700000010", reading.Name, reading.Model, reading.LastSeen)
+		}
+		if reading.TemperatureCelsius == nil || *reading.TemperatureCelsius != temperature || reading.BatteryPercent == nil || *reading.BatteryPercent != battery {
+			t.Errorf("got %v %v, want the temperature and battery merged across both frames", reading.TemperatureCelsius, reading.BatteryPercent)
+		}
+		return
+	}
+	t.Errorf("aa:bb:cc:dd:ee:10 missing from %s", w.Body.String())
+}
+
+func TestPayloadHashesOnlyForKnownDevices(t *testing.T) {
+	defer func(timeout time.Duration) { flagDeviceTimeout = timeout }(flagDeviceTimeout)
+	flagDeviceTimeout = 15 * time.Minute
+	known, unknown := "a4:c1:38:00:00:65", "aa:bb:cc:dd:ee:60"
+	atc, _ := hex.DecodeString("02010610161a18a4c13800006500f43c640bb80a") // ATC 24.4C 60% 100%
+	advScanHandler(&simulatedAdvertisement{addr: known, rssi: -60, data: atc})
+	advScanHandler(&simulatedAdvertisement{addr: unknown, rssi: -60, data: []byte{0x02, 0x01, 0x06}})
+	tracked := func(mac string) bool {
+		payloadHashMutex.RLock()
+		defer payloadHashMutex.RUnlock()
+		_, ok := payloadHashMap[mac]
+		return ok
+	}
+	if !tracked(known) {
+		t.Errorf("known device : payload hash not tracked")
+	}
+	if tracked(unknown) {
+		t.Errorf("unknown device : payload hash tracked")
+	}
+	expireDevices(time.Now().Add(flagDeviceTimeout + time.Minute))
+	if tracked(known) {
+		t.Errorf("timed out : payload hash still tracked")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Per device metrics are defined through this registry, so names consistently follow the
+// prometheus conventions (btle_exporter_device_<name>_<unit>). A renamed metric keeps being
+// exported under its old names for a release, so existing dashboards don't break.
+
+// deviceLabelNames are the labels of every device metric : mac, name and model, then the
+// optional labels enabled by flags. initDeviceLabels settles them once after parseFlags,
+// and the metrics are only registered on first use, so every series of a metric gets the
+// same label set. Build the labels with deviceLabels, never by hand.
+var deviceLabelNames = []string{"mac", "name", "model"}
+
+type deviceLabel struct {
+	name    string
+	enabled func() bool
+	value   func(mac string) string
+}
+
+var optionalDeviceLabels = []deviceLabel{ // Labels behind flags, in the order they follow model
+	{"location", func() bool { return len(flagLocation) > 0 }, func(mac string) string { return flagLocation }}, // Tells sites apart when several exporters feed one prometheus
+}
+var activeDeviceLabels []deviceLabel // The enabled ones, set by initDeviceLabels
+
+func initDeviceLabels() {
+	deviceLabelNames = []string{"mac", "name", "model"}
+	activeDeviceLabels = nil
+	for _, l := range optionalDeviceLabels {
+		if l.enabled() {
+			deviceLabelNames = append(deviceLabelNames, l.name)
+			activeDeviceLabels = append(activeDeviceLabels, l)
+		}
+	}
+}
+
+func deviceLabels(mac string, name string, model string) prometheus.Labels {
+	labels := prometheus.Labels{"mac": mac, "name": name, "model": model}
+	for _, l := range activeDeviceLabels {
+		labels[l.name] = l.value(mac)
+	}
+	return labels
+}
+
+type deviceGaugeOpts struct {
+	Name        string   // Without the btle_exporter_device_ prefix and the unit suffix
+	Unit        string   // Base unit suffix (celsius, percent, dbm, ...), empty for unitless
+	Help        string   // Without the unit, which gets appended
+	ExtraLabels []string // Labels on top of deviceLabelNames
+	Deprecated  []string // Full names the metric used to be exported as
+}
+
+type deviceGaugeVec struct {
+	opts       deviceGaugeOpts
+	registerer prometheus.Registerer // prometheus.DefaultRegisterer when nil
+	once       sync.Once
+	vecs       []*prometheus.GaugeVec // The current name first, then the deprecated aliases
+}
+
+func newDeviceGaugeVec(opts deviceGaugeOpts) *deviceGaugeVec {
+	return &deviceGaugeVec{opts: opts}
+}
+
+func (g *deviceGaugeVec) register() {
+	g.once.Do(func() {
+		registerer := g.registerer
+		if registerer == nil {
+			registerer = prometheus.DefaultRegisterer
+		}
+		name := "btle_exporter_device_" + g.opts.Name
+		help := g.opts.Help
+		if g.opts.Unit != "" {
+			name = name + "_" + g.opts.Unit
+			help = help + " in " + g.opts.Unit
+		}
+		labelNames := append(append([]string{}, deviceLabelNames...), g.opts.ExtraLabels...)
+		g.vecs = append(g.vecs, prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames))
+		for _, deprecatedName := range g.opts.Deprecated {
+			g.vecs = append(g.vecs, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: deprecatedName,
+				Help: "DEPRECATED, use " + name + " instead. " + help,
+			}, labelNames))
+		}
+		for _, vec := range g.vecs {
+			registerer.MustRegister(vec)
+		}
+	})
+}
+
+func (g *deviceGaugeVec) Set(labels prometheus.Labels, value float64) {
+	g.register()
+	for _, vec := range g.vecs {
+		vec.With(labels).Set(value)
+	}
+}
+
+func (g *deviceGaugeVec) Delete(labels prometheus.Labels) {
+	g.register()
+	for _, vec := range g.vecs {
+		vec.Delete(labels)
+	}
+}
+
+type deviceCounterVec struct { // A CounterVec over deviceLabelNames, registered on first use like deviceGaugeVec
+	opts prometheus.CounterOpts
+	once sync.Once
+	vec  *prometheus.CounterVec
+}
+
+func newDeviceCounterVec(opts prometheus.CounterOpts) *deviceCounterVec {
+	return &deviceCounterVec{opts: opts}
+}
+
+func (c *deviceCounterVec) Inc(labels prometheus.Labels) {
+	c.once.Do(func() {
+		c.vec = promauto.NewCounterVec(c.opts, deviceLabelNames)
+	})
+	c.vec.With(labels).Inc()
+}
+
+var (
+	metricsDeviceTemperatureGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "temperature", Unit: "celsius", Help: "Current temperature reading",
+		Deprecated: []string{"btle_exporter_device_temperature_celcius"},
+	})
+	metricsDeviceHumidityGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "humidity", Unit: "percent", Help: "Current humidity reading",
+	})
+	metricsDeviceBatteryGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "battery", Unit: "percent", Help: "Current battery reading",
+	})
+	metricsDeviceBatteryDrainGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "battery_drain_per_day", Help: "Battery percent lost per day, fitted over up to a week of hourly readings once they span 2 days",
+	})
+	metricsDeviceCO2Gauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "co2", Unit: "ppm", Help: "Current CO2 concentration reading",
+	})
+	metricsDevicePressureGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "pressure", Unit: "pascal", Help: "Current barometric pressure reading",
+	})
+	metricsDeviceVOCGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "voc", Unit: "index", Help: "Current volatile organic compounds (VOC) reading",
+	})
+	metricsDeviceGravityGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "gravity", Help: "Current specific gravity reading",
+		ExtraLabels: []string{"color"},
+	})
+	metricsDeviceIlluminanceGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "illuminance", Unit: "lux", Help: "Current illuminance reading",
+	})
+	metricsDeviceDewPointGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "dewpoint", Unit: "celsius", Help: "Current dew point reading, as reported by the device",
+	})
+	metricsDeviceHeartRateGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "heart_rate", Unit: "bpm", Help: "Current heart rate reading",
+	})
+	metricsDeviceAccelerationGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "acceleration", Unit: "g", Help: "Current acceleration reading",
+		ExtraLabels: []string{"axis"},
+	})
+	metricsDeviceTxPowerGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "tx_power", Unit: "dbm", Help: "Transmit power the device reports using",
+	})
+	metricsDeviceMotionGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "motion", Help: "Whether motion was detected recently (1) or not (0)",
+	})
+	metricsDeviceSignalGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "signal", Unit: "dbm", Help: "Current signal strength (RSSI)",
+		Deprecated: []string{"btle_exporter_device_signal_rssi"},
+	})
+	metricsDeviceUpGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "up", Help: "Whether the device was heard within -device-timeout (1) or not (0), removed after -device-up-grace",
+	})
+	metricsDeviceAdvertisementLastSeenGauge = newDeviceGaugeVec(deviceGaugeOpts{
+		Name: "advertisement_lastseen", Unit: "seconds", Help: "Unixtimestamp of when the last advertisement was seen",
+	})
+)
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLocationLabel(t *testing.T) {
+	defer func(location string) {
+		flagLocation = location
+		initDeviceLabels()
+	}(flagLocation)
+	flagLocation = ""
+	initDeviceLabels()
+	if _, ok := deviceLabels("aa:bb:cc:dd:ee:61", "name", "ATC")["location"]; ok {
+		t.Errorf("got a location label without -location")
+	}
+	flagLocation = "garage"
+	initDeviceLabels()
+	if got := deviceLabels("aa:bb:cc:dd:ee:61", "name", "ATC")["location"]; got != "garage" {
+		t.Errorf("got location %q, want garage", got)
+	}
+}
+
+func TestDeviceLabelCombinations(t *testing.T) {
+	defer func(optional []deviceLabel) {
+		optionalDeviceLabels = optional
+		initDeviceLabels()
+	}(optionalDeviceLabels)
+	enabled := map[string]bool{}
+	optionalDeviceLabels = []deviceLabel{
+		{"first", func() bool { return enabled["first"] }, func(mac string) string { return "1" }},
+		{"second", func() bool { return enabled["second"] }, func(mac string) string { return "2" }},
+	}
+	for combination := 0; combination < 1<<len(optionalDeviceLabels); combination++ {
+		want := 3
+		for i, l := range optionalDeviceLabels {
+			enabled[l.name] = combination&(1<<i) != 0
+			if enabled[l.name] {
+				want++
+			}
+		}
+		initDeviceLabels()
+		if len(deviceLabelNames) != want {
+			t.Errorf("combination %d : got labels %v, want %d", combination, deviceLabelNames, want)
+		}
+		registry := prometheus.NewRegistry()
+		gauge := &deviceGaugeVec{opts: deviceGaugeOpts{Name: "test", Deprecated: []string{"btle_exporter_device_test_old"}}, registerer: registry}
+		gravity := &deviceGaugeVec{opts: deviceGaugeOpts{Name: "test_gravity", ExtraLabels: []string{"color"}}, registerer: registry}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("combination %d : %v", combination, r)
+				}
+			}()
+			labels := deviceLabels("aa:bb:cc:dd:ee:60", "name", "ATC")
+			gauge.Set(labels, 1)
+			gauge.Delete(labels)
+			labels["color"] = "Red"
+			gravity.Set(labels, 1)
+		}()
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Publishes every reading as json to <-mqtt-topic-prefix>/<mac>/state, and with
+// -mqtt-ha-discovery announces the sensors to Home Assistant so it creates the
+// entities itself (https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery).
+
+const mqttDisconnectQuiesce = 250 // Milliseconds for in flight messages on disconnect
+
+var mqttClient mqtt.Client
+
+var metricsMQTTConnectedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "btle_exporter_mqtt_connected",
+	Help: "Whether the -mqtt-broker connection is up (1) or being retried (0)",
+})
+
+var metricsMQTTDroppedCount = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "btle_exporter_mqtt_dropped_count",
+	Help: "The total number of readings not published because the -mqtt-broker connection was down",
+})
+var mqttAnnouncedMap = make(map[string]map[string]bool) // MAC -> Discovery configs published
+var mqttAnnouncedMutex = &sync.RWMutex{}
+
+type haSensor struct {
+	key         string // Object id suffix
+	name        string
+	field       string // Key in the state json
+	unit        string
+	deviceClass string
+	value       func(r *deviceReading) *float64
+}
+
+var haSensors = []haSensor{
+	{"temperature", "Temperature", "temperature_celsius", "°C", "temperature", func(r *deviceReading) *float64 { return r.TemperatureCelsius }},
+	{"humidity", "Humidity", "humidity_percent", "%", "humidity", func(r *deviceReading) *float64 { return r.HumidityPercent }},
+	{"battery", "Battery", "battery_percent", "%", "battery", func(r *deviceReading) *float64 { return r.BatteryPercent }},
+	{"co2", "CO2", "co2_ppm", "ppm", "carbon_dioxide", func(r *deviceReading) *float64 { return r.CO2PPM }},
+	{"pressure", "Pressure", "pressure_pascal", "Pa", "atmospheric_pressure", func(r *deviceReading) *float64 { return r.PressurePascal }},
+	{"voc", "VOC index", "voc_index", "", "", func(r *deviceReading) *float64 { return r.VOCIndex }},
+	{"gravity", "Specific gravity", "gravity", "", "", func(r *deviceReading) *float64 { return r.SpecificGravity }},
+	{"illuminance", "Illuminance", "illuminance_lux", "lx", "illuminance", func(r *deviceReading) *float64 { return r.IlluminanceLux }},
+	{"dewpoint", "Dew point", "dewpoint_celsius", "°C", "temperature", func(r *deviceReading) *float64 { return r.DewPointCelsius }},
+	{"heart_rate", "Heart rate", "heart_rate_bpm", "bpm", "", func(r *deviceReading) *float64 { return r.HeartRateBPM }},
+	{"acceleration_x", "Acceleration X", "acceleration_x_g", "g", "", func(r *deviceReading) *float64 { return r.AccelerationXG }},
+	{"acceleration_y", "Acceleration Y", "acceleration_y_g", "g", "", func(r *deviceReading) *float64 { return r.AccelerationYG }},
+	{"acceleration_z", "Acceleration Z", "acceleration_z_g", "g", "", func(r *deviceReading) *float64 { return r.AccelerationZG }},
+}
+
+type haDevice struct {
+	Identifiers []string    `json:"identifiers"`
+	Connections [][2]string `json:"connections"`
+	Name        string      `json:"name"`
+	Model       string      `json:"model"`
+}
+
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	ObjectID          string   `json:"object_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class"`
+	EntityCategory    string   `json:"entity_category,omitempty"`
+	ExpireAfter       int      `json:"expire_after,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+func mqttObjectID(mac string) string { // Discovery topics only allow [a-zA-Z0-9_-]
+	return strings.ReplaceAll(mac, ":", "")
+}
+
+func mqttStateTopic(mac string) string {
+	return flagMQTTTopicPrefix + "/" + mac + "/state"
+}
+
+func mqttStart() {
+	clientID, _ := os.Hostname()
+	opts := mqtt.NewClientOptions().
+		AddBroker(flagMQTTBroker).
+		SetClientID(fmt.Sprintf("%s-%s-%d", applicationName, clientID, os.Getpid())).
+		SetUsername(flagMQTTUsername).
+		SetPassword(flagMQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true). // Keep trying in the background when the broker isn't up yet
+		SetConnectRetryInterval(10 * time.Second).
+		SetOnConnectHandler(func(mqtt.Client) {
+			logInfo("Connected to MQTT broker %s", flagMQTTBroker)
+			metricsMQTTConnectedGauge.Set(1)
+			mqttAnnouncedMutex.Lock()
+			mqttAnnouncedMap = make(map[string]map[string]bool) // Announce again, the broker may have lost the retained configs
+			mqttAnnouncedMutex.Unlock()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logWarn("Lost connection to MQTT broker %s - %v, reconnecting", flagMQTTBroker, err)
+			metricsMQTTConnectedGauge.Set(0)
+		})
+	mqttClient = mqtt.NewClient(opts)
+	mqttClient.Connect() // Doesn't complete until connected, the handlers log the outcome
+}
+
+func mqttPublish(reading *deviceReading) { // Called for every exported reading, never blocks on the broker
+	if mqttClient == nil {
+		return
+	}
+	if !mqttClient.IsConnectionOpen() {
+		metricsMQTTDroppedCount.Inc()
+		return
+	}
+	if flagMQTTHADiscovery {
+		mqttAnnounce(reading)
+	}
+	payload, err := json.Marshal(reading)
+	if err != nil {
+		logWarn("Failed to encode MQTT reading for %s - %v", reading.Mac, err)
+		return
+	}
+	mqttClient.Publish(mqttStateTopic(reading.Mac), 0, false, payload)
+}
+
+func mqttAnnounce(reading *deviceReading) { // Publishes the discovery configs of the sensors first seen in this reading
+	mqttAnnouncedMutex.Lock()
+	announced, ok := mqttAnnouncedMap[reading.Mac]
+	if !ok {
+		announced = make(map[string]bool)
+		mqttAnnouncedMap[reading.Mac] = announced
+	}
+	var pending []haSensor
+	for _, s := range haSensors {
+		if s.value(reading) != nil && !announced[s.key] {
+			announced[s.key] = true
+			pending = append(pending, s)
+		}
+	}
+	if !announced["signal"] {
+		announced["signal"] = true
+		pending = append(pending, haSensor{"signal", "Signal", "rssi", "dBm", "signal_strength", nil})
+	}
+	mqttAnnouncedMutex.Unlock()
+	for _, s := range pending {
+		topic, payload, err := haDiscoveryConfig(reading, s)
+		if err != nil {
+			logWarn("Failed to encode MQTT discovery config for %s - %v", reading.Mac, err)
+			continue
+		}
+		mqttClient.Publish(topic, 1, true, payload) // Retained, so Home Assistant finds it after a restart
+	}
+}
+
+func haDiscoveryConfig(reading *deviceReading, s haSensor) (string, []byte, error) {
+	objectID := mqttObjectID(reading.Mac) + "_" + s.key
+	name := reading.Name
+	if len(name) == 0 {
+		name = reading.Model + " " + reading.Mac
+	}
+	config := haConfig{
+		Name:              s.name,
+		UniqueID:          applicationName + "_" + objectID,
+		ObjectID:          objectID,
+		StateTopic:        mqttStateTopic(reading.Mac),
+		ValueTemplate:     "{{ value_json." + s.field + " }}",
+		UnitOfMeasurement: s.unit,
+		DeviceClass:       s.deviceClass,
+		StateClass:        "measurement",
+		ExpireAfter:       int(flagDeviceTimeout.Seconds()), // Unavailable once it stops advertising
+		Device: haDevice{
+			Identifiers: []string{applicationName + "_" + mqttObjectID(reading.Mac)},
+			Connections: [][2]string{{"mac", reading.Mac}},
+			Name:        name,
+			Model:       reading.Model,
+		},
+	}
+	if s.key == "signal" || s.key == "battery" {
+		config.EntityCategory = "diagnostic"
+	}
+	payload, err := json.Marshal(config)
+	return flagMQTTHAPrefix + "/sensor/" + objectID + "/config", payload, err
+}
+
+func mqttDisconnect() {
+	if mqttClient == nil {
+		return
+	}
+	mqttClient.Disconnect(mqttDisconnectQuiesce)
+}
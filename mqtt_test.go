@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHADiscoveryConfig(t *testing.T) {
+	defer func(prefix, haPrefix string) { flagMQTTTopicPrefix, flagMQTTHAPrefix = prefix, haPrefix }(flagMQTTTopicPrefix, flagMQTTHAPrefix)
+	flagMQTTTopicPrefix, flagMQTTHAPrefix = "btle_exporter", "homeassistant"
+	temperature := 21.5
+	reading := &deviceReading{Mac: "a4:c1:38:00:00:02", Model: "ATC", TemperatureCelsius: &temperature}
+	topic, payload, err := haDiscoveryConfig(reading, haSensors[0])
+	if err != nil {
+		t.Fatalf("encode : %v", err)
+	}
+	if want := "homeassistant/sensor/a4c138000002_temperature/config"; topic != want {
+		t.Errorf("got topic %q, want %q", topic, want)
+	}
+	var config haConfig
+	if err := json.Unmarshal(payload, &config); err != nil {
+		t.Fatalf("decode : %v", err)
+	}
+	if config.StateTopic != "btle_exporter/a4:c1:38:00:00:02/state" || config.ValueTemplate != "{{ value_json.temperature_celsius }}" {
+		t.Errorf("got state topic %q template %q", config.StateTopic, config.ValueTemplate)
+	}
+	if config.Device.Name != "ATC a4:c1:38:00:00:02" || config.Device.Model != "ATC" {
+		t.Errorf("got device %+v", config.Device)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSanitizeName(t *testing.T) {
+	defer func(previous string) { flagSanitizeNames = previous }(flagSanitizeNames)
+	for _, tc := range []struct {
+		mode, name, want string
+	}{
+		{"off", "  Living \\t room ", "  Living \\t room "},
+		{"trim", "  Living \t room ", "Living room"},
+		{"underscore", "  Living \t room ", "Living_room"},
+	} {
+		flagSanitizeNames = tc.mode
+		if got := sanitizeName(tc.name); got != tc.want {
+			t.Errorf("%s : sanitizeName(%q) = %q, want %q", tc.mode, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLoadNamesCSVFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"whitespace", "  \n\n\t\n", map[string]string{}},
+		{"bom only", "\xef\xbb\xbf", map[string]string{}},
+		{"bom", "\xef\xbb\xbfA4:C1:38:D0:2C:EC,Kitchen\na4:c1:38:00:00:02,Garage,ATC\n", map[string]string{"a4:c1:38:d0:2c:ec": "Kitchen", "a4:c1:38:00:00:02": "Garage"}},
+	} {
+		file := filepath.Join(dir, tc.name+".csv")
+		if err := os.WriteFile(file, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadNamesCSVFile(file)
+		if err != nil {
+			t.Errorf("%s : %v", tc.name, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s : got %v, want %v", tc.name, got, tc.want)
+		}
+		for mac, name := range tc.want {
+			if got[mac] != name {
+				t.Errorf("%s : got %q for %s, want %q", tc.name, got[mac], mac, name)
+			}
+		}
+	}
+}
+
+func TestUpdateLocalNamePrefersComplete(t *testing.T) {
+	mac := "aa:bb:cc:dd:ee:40"
+	short := []byte{0x05, 0x08, 'A', 'T', 'C', '_'}
+	complete := []byte{0x0b, 0x09, 'A', 'T', 'C', '_', 'D', '0', '2', 'C', 'E', 'C'}
+	for i, step := range []struct {
+		payload []byte
+		want    string
+	}{
+		{short, "ATC_"},
+		{complete, "ATC_D02CEC"},
+		{short, "ATC_D02CEC"}, // A shortened name doesn't clobber the complete one
+		{nil, "ATC_D02CEC"},
+	} {
+		if got := updateLocalName(mac, "", step.payload); got != step.want {
+			t.Errorf("step %d : got %q, want %q", i, got, step.want)
+		}
+	}
+	if got, _ := parseLocalNames([]byte{0x09, 0x09, 'c', 'u', 't'}); got != "" { // Truncated
+		t.Errorf("truncated : got %q, want no name", got)
+	}
+	expireLocalNames(time.Now().Add(flagDeviceTimeout + time.Minute))
+	if got := bestLocalName(mac); got != "" {
+		t.Errorf("timed out : got %q, want no name", got)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Mirrors the device gauges as OpenTelemetry instruments and pushes them to
+// -otlp-endpoint every -otlp-interval, for setups without a prometheus scraper.
+
+var otlpMeterProvider *sdkmetric.MeterProvider
+var otlpShutdownOnce sync.Once
+
+type otlpGauge struct {
+	name  string
+	unit  string
+	help  string
+	value func(r *deviceReading) *float64
+}
+
+var otlpGauges = []otlpGauge{
+	{"btle_exporter.device.temperature", "Cel", "Temperature", func(r *deviceReading) *float64 { return r.TemperatureCelsius }},
+	{"btle_exporter.device.humidity", "%", "Humidity", func(r *deviceReading) *float64 { return r.HumidityPercent }},
+	{"btle_exporter.device.battery", "%", "Battery", func(r *deviceReading) *float64 { return r.BatteryPercent }},
+	{"btle_exporter.device.co2", "ppm", "CO2 concentration", func(r *deviceReading) *float64 { return r.CO2PPM }},
+	{"btle_exporter.device.pressure", "Pa", "Atmospheric pressure", func(r *deviceReading) *float64 { return r.PressurePascal }},
+	{"btle_exporter.device.voc", "{index}", "VOC index", func(r *deviceReading) *float64 { return r.VOCIndex }},
+	{"btle_exporter.device.gravity", "1", "Specific gravity", func(r *deviceReading) *float64 { return r.SpecificGravity }},
+	{"btle_exporter.device.illuminance", "lx", "Illuminance", func(r *deviceReading) *float64 { return r.IlluminanceLux }},
+	{"btle_exporter.device.dewpoint", "Cel", "Dew point", func(r *deviceReading) *float64 { return r.DewPointCelsius }},
+	{"btle_exporter.device.heart_rate", "{beat}/min", "Heart rate", func(r *deviceReading) *float64 { return r.HeartRateBPM }},
+	{"btle_exporter.device.acceleration.x", "g", "Acceleration along x", func(r *deviceReading) *float64 { return r.AccelerationXG }},
+	{"btle_exporter.device.acceleration.y", "g", "Acceleration along y", func(r *deviceReading) *float64 { return r.AccelerationYG }},
+	{"btle_exporter.device.acceleration.z", "g", "Acceleration along z", func(r *deviceReading) *float64 { return r.AccelerationZG }},
+	{"btle_exporter.device.tx_power", "dBm", "Transmit power", func(r *deviceReading) *float64 { return r.TxPowerDBm }},
+	{"btle_exporter.device.motion", "1", "Motion detected within -motion-timeout", func(r *deviceReading) *float64 {
+		if r.Motion == nil { // Never reported motion, not a motion sensor
+			return nil
+		}
+		motion := 0.0
+		if motionActive(r.Mac) {
+			motion = 1
+		}
+		return &motion
+	}},
+	{"btle_exporter.device.signal", "dBm", "Signal strength", func(r *deviceReading) *float64 {
+		rssi := float64(r.RSSI)
+		return &rssi
+	}},
+}
+
+func otlpStart() error {
+	ctx := context.Background()
+	var opts []otlpmetrichttp.Option
+	if strings.Contains(flagOTLPEndpoint, "://") {
+		opts = append(opts, otlpmetrichttp.WithEndpointURL(flagOTLPEndpoint))
+	} else { // Plain host:port, collectors are usually on the local network without tls
+		opts = append(opts, otlpmetrichttp.WithEndpoint(flagOTLPEndpoint), otlpmetrichttp.WithInsecure())
+	}
+	exporter, err := otlpmetrichttp.New(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	otlpMeterProvider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(flagOTLPInterval))),
+		sdkmetric.WithResource(resource.NewSchemaless(semconv.ServiceName(applicationName), semconv.ServiceVersion(BuildVersion))),
+	)
+	meter := otlpMeterProvider.Meter(applicationName)
+
+	instruments := make([]metric.Float64ObservableGauge, len(otlpGauges))
+	observables := make([]metric.Observable, len(otlpGauges))
+	for i, g := range otlpGauges {
+		instruments[i], err = meter.Float64ObservableGauge(g.name, metric.WithUnit(g.unit), metric.WithDescription(g.help))
+		if err != nil {
+			return err
+		}
+		observables[i] = instruments[i]
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		for _, device := range listDevices() {
+			reading := &device.reading
+			attrs := []attribute.KeyValue{
+				attribute.String("mac", reading.Mac),
+				attribute.String("name", reading.Name),
+				attribute.String("model", reading.Model),
+			}
+			if len(reading.Color) > 0 {
+				attrs = append(attrs, attribute.String("color", reading.Color))
+			}
+			for i, g := range otlpGauges {
+				if v := g.value(reading); v != nil {
+					o.ObserveFloat64(instruments[i], *v, metric.WithAttributes(attrs...))
+				}
+			}
+		}
+		return nil
+	}, observables...)
+	if err != nil {
+		return err
+	}
+	logInfo("Pushing metrics over OTLP to %s every %s", flagOTLPEndpoint, flagOTLPInterval)
+	return nil
+}
+
+func otlpShutdown() { // Safe to call from every exit path, only the first call flushes
+	if otlpMeterProvider == nil {
+		return
+	}
+	otlpShutdownOnce.Do(func() {
+		if err := otlpMeterProvider.Shutdown(context.Background()); err != nil { // Flushes the last readings
+			logWarn("Failed to shut down OTLP exporter - %v", err)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func parseHex(t *testing.T, data string) (*SensorData, error) {
+	t.Helper()
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		t.Fatalf("bad hex %q : %v", data, err)
+	}
+	complete, short := parseLocalNames(raw) // As advScanHandler would know it
+	if len(complete) == 0 {
+		complete = short
+	}
+	return parseAdvertisementReportData(raw, complete)
+}
+
+func TestParseCorruptAdvertisements(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"empty", "", false},
+		{"single byte", "02", false},
+		{"zero length padding", "0201060000", false},
+		{"length overruns buffer", "0201061016", true},
+		{"truncated service data", "0201061216950e", true},
+		{"length byte only at end", "02010603", false},
+		{"type byte only", "0201060116", false},
+		{"empty manufacturer data", "02010601ff", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseHex(t, tc.data)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("parse %s : got err %v, want err %v", tc.data, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTruncatedFixtures(t *testing.T) { // Every decoder sees each of its frames cut short, none may panic
+	for _, fixture := range simulatedFixtures {
+		data, err := hex.DecodeString(fixture.data)
+		if err != nil {
+			t.Fatalf("fixture %s : %v", fixture.mac, err)
+		}
+		for n := 1; n < len(data); n++ {
+			for _, cut := range [][]byte{data[:n], append([]byte{byte(len(data) - 1)}, data[1:n]...)} { // Also with the first length byte claiming the whole frame
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("fixture %s cut to %d bytes (%x) : panic %v", fixture.mac, len(cut), cut, r)
+						}
+					}()
+					parseAdvertisementReportData(cut, "")
+				}()
+			}
+		}
+	}
+}
+
+func TestParseSimulatedFixtures(t *testing.T) {
+	want := map[string]SensorData{
+		"4c:65:a8:00:00:01": {Model: "LYWSDCGQ", TemperatureCelsius: 22.8, HumidityPercent: 60.2},
+		"a4:c1:38:00:00:02": {Model: "ATC", TemperatureCelsius: 24.4, HumidityPercent: 60, BatteryPercent: 66},
+		"a4:c1:38:00:00:0a": {Model: "ATC2", TemperatureCelsius: 24.4, HumidityPercent: 60.53, BatteryPercent: 66},
+		"a4:c1:38:00:00:07": {Model: "pvvx", TemperatureCelsius: -5.25, HumidityPercent: 81.5, BatteryPercent: 85},
+		"d0:12:34:00:00:03": {Model: "Aranet4", TemperatureCelsius: 22.5, HumidityPercent: 45, BatteryPercent: 90, CO2PPM: 600, PressurePascal: 101320},
+		"e0:11:22:00:00:04": {Model: "Tilt", TemperatureCelsius: 20, SpecificGravity: 1.016, Color: "Red"},
+		"78:11:dc:00:00:05": {Model: "MJYD02YL", IlluminanceLux: 100},
+		"54:ef:44:00:00:06": {Model: "RTCGQ02LM", IlluminanceLux: 300, Motion: 1},
+		"c7:3a:00:00:00:0b": {Model: "Ruuvi", TemperatureCelsius: -1.69, HumidityPercent: 20.5, BatteryPercent: 79.8, PressurePascal: 102766},
+		"a4:c1:38:00:00:09": {Model: "GoveeH5179", TemperatureCelsius: 21.5, HumidityPercent: 45.5, BatteryPercent: 88},
+		"f4:5e:ab:00:00:08": {Model: "BlueMaestro", TemperatureCelsius: 25.1, HumidityPercent: 50, BatteryPercent: 86, DewPointCelsius: 13.9},
+		"a0:9e:1a:00:00:0c": {Model: "HeartRate", HeartRateBPM: 72},
+		"a4:c1:38:00:00:0d": {Model: "LYWSD03MMC", TemperatureCelsius: 22.8, HumidityPercent: 60.2},
+		"cb:b8:33:00:00:0f": {Model: "RuuviTag5", TemperatureCelsius: 24.3, HumidityPercent: 53.49, BatteryPercent: 95.4, PressurePascal: 100044},
+		"b7:40:00:00:00:12": {Model: "BTHome", TemperatureCelsius: 25, HumidityPercent: 46.93, BatteryPercent: 97},
+		"49:42:53:00:00:11": {Model: "Inkbird", TemperatureCelsius: 21, HumidityPercent: 35.12, BatteryPercent: 85},
+		"e4:5b:00:00:00:10": {Model: "SwitchBotMeter", TemperatureCelsius: 22.5, HumidityPercent: 53, BatteryPercent: 100},
+		"a4:c1:38:00:00:0e": {Model: "GVH5075", TemperatureCelsius: 25.2, HumidityPercent: 32.3, BatteryPercent: 100},
+	}
+	for _, fixture := range simulatedFixtures {
+		t.Run(fixture.mac, func(t *testing.T) {
+			w, ok := want[fixture.mac]
+			if !ok {
+				t.Fatalf("no expectation for fixture %s", fixture.mac)
+			}
+			got, err := parseHex(t, fixture.data)
+			if err != nil {
+				t.Fatalf("parse : %v", err)
+			}
+			if got.Model != w.Model || got.Color != w.Color {
+				t.Errorf("got model %q color %q, want %q %q", got.Model, got.Color, w.Model, w.Color)
+			}
+			for _, r := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"temperature", got.TemperatureCelsius, w.TemperatureCelsius},
+				{"humidity", got.HumidityPercent, w.HumidityPercent},
+				{"battery", got.BatteryPercent, w.BatteryPercent},
+				{"co2", got.CO2PPM, w.CO2PPM},
+				{"pressure", got.PressurePascal, w.PressurePascal},
+				{"gravity", got.SpecificGravity, w.SpecificGravity},
+				{"illuminance", got.IlluminanceLux, w.IlluminanceLux},
+				{"dewpoint", got.DewPointCelsius, w.DewPointCelsius},
+				{"heart rate", got.HeartRateBPM, w.HeartRateBPM},
+				{"motion", got.Motion, w.Motion},
+			} {
+				if r.want == 0 {
+					r.want = undefined // Unset in the table means not present in the frame
+				}
+				if diff := r.got - r.want; diff > 0.001 || diff < -0.001 {
+					t.Errorf("%s : got %g, want %g", r.name, r.got, r.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseEncryptedMiBeacon(t *testing.T) {
+	got, err := parseHex(t, "020106141695fe5820f60701050000dc1178071003640000") // MJYD02YL frame with the encrypted bit set
+	if err != nil {
+		t.Fatalf("parse : %v", err)
+	}
+	if got.Model != "MJYD02YL" || got.IlluminanceLux != undefined {
+		t.Errorf("got model %q illuminance %g, want MJYD02YL with no reading", got.Model, got.IlluminanceLux)
+	}
+}
+
+func TestParseNegativeTemperatures(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want float64
+	}{
+		{"ATC", "02010610161a18a4c138000002ffce3c420bb80a", -5.0},
+		{"LYWSDCGQ", "020106131695fe5020aa0101010000a8654c04100285ff", -12.3},
+	} {
+		got, err := parseHex(t, tc.data)
+		if err != nil {
+			t.Fatalf("%s : parse : %v", tc.name, err)
+		}
+		if diff := got.TemperatureCelsius - tc.want; diff > 0.001 || diff < -0.001 {
+			t.Errorf("%s : got %g, want %g", tc.name, got.TemperatureCelsius, tc.want)
+		}
+	}
+}
+
+func TestParseSkipCompanyIDs(t *testing.T) {
+	skipCompanyIDs[0x0702] = true
+	defer delete(skipCompanyIDs, 0x0702)
+	got, err := parseHex(t, "19ff020721130401000c0f015802c20194272d5a012c012a0007") // Aranet4
+	if err != nil {
+		t.Fatalf("parse : %v", err)
+	}
+	if got.Model != "Skipped" || got.CO2PPM != undefined {
+		t.Errorf("got model %q co2 %g, want Skipped with no reading", got.Model, got.CO2PPM)
+	}
+}
+
+func TestParseExtendedAdvertisingPayload(t *testing.T) {
+	name := "Extended advertising local name, longer than 31 bytes on its own"
+	data := "020106" + hex.EncodeToString([]byte{byte(len(name) + 1), 0x09}) + hex.EncodeToString([]byte(name)) +
+		"ff" + "ff" + strings.Repeat("00", 254) + // Largest possible AD structure, unknown manufacturer
+		"10161a18a4c13800000200f43c420bb80a" // ATC
+	got, err := parseHex(t, data)
+	if err != nil {
+		t.Fatalf("parse : %v", err)
+	}
+	if got.Model != "ATC" || got.TemperatureCelsius != 24.4 {
+		t.Errorf("got model %q temperature %g, want ATC 24.4", got.Model, got.TemperatureCelsius)
+	}
+}
+
+func TestRoundTo(t *testing.T) {
+	for _, tc := range []struct{ value, step, want float64 }{
+		{22.84, 0, 22.84},
+		{22.84, 0.5, 23},
+		{22.74, 0.5, 22.5},
+		{-5.26, 1, -5},
+		{undefined, 0.5, undefined},
+	} {
+		if got := roundTo(tc.value, tc.step); got != tc.want {
+			t.Errorf("roundTo(%g, %g) = %g, want %g", tc.value, tc.step, got, tc.want)
+		}
+	}
+}
+
+func TestLogValue(t *testing.T) {
+	for value, want := range map[float64]string{undefined: "n/a", 22.84: "22.8", -1: "-1.0", 0: "0.0"} {
+		if got := logValue(value); got != want {
+			t.Errorf("logValue(%g) : got %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestParseCorruptXiaomiReading(t *testing.T) {
+	got, err := parseHex(t, "020106131695fe5020aa0101010000a8654c06100201ff") // LYWSDCGQ humidity of 6527.3%
+	if err == nil {
+		t.Errorf("got humidity %g, want a parse error", got.HumidityPercent)
+	}
+	if got.Model != "LYWSDCGQ" {
+		t.Errorf("got model %q, want LYWSDCGQ", got.Model)
+	}
+}
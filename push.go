@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Exporters behind NAT can't be scraped, -pushgateway-url pushes the same registry to a
+// Pushgateway every -pushgateway-interval instead.
+
+const pushTimeout = 10 * time.Second
+
+var metricsPushErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "btle_exporter_push_error_count",
+	Help: "The total number of failed pushes to -pushgateway-url",
+})
+
+func newPusher() *push.Pusher {
+	instance, _ := os.Hostname()
+	return push.New(flagPushgatewayURL, flagPushgatewayJob).
+		Gatherer(prometheus.DefaultGatherer).
+		Grouping("instance", instance). // Several gateways may push under the same job
+		Client(&http.Client{Timeout: pushTimeout})
+}
+
+func pushPeriodically() {
+	pusher := newPusher()
+	logInfo("Pushing metrics to %s every %s", flagPushgatewayURL, flagPushgatewayInterval)
+	ticker := time.NewTicker(flagPushgatewayInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := pusher.Push(); err != nil {
+			metricsPushErrorCount.Inc() // Shows up in the next successful push
+			logWarn("Failed to push metrics to %s - %v", flagPushgatewayURL, err)
+		}
+	}
+}
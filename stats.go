@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per model decoder statistics, served as json on /stats for status pages.
+
+type modelStats struct {
+	Devices        int   `json:"devices"`
+	Advertisements int64 `json:"advertisements"`
+	Decoded        int64 `json:"decoded"`
+	LastSeen       int64 `json:"lastseen"`
+}
+
+type statsResponse struct {
+	Models map[string]*modelStats `json:"models"`
+	Totals modelStats             `json:"totals"`
+	Uptime float64                `json:"uptime_seconds"`
+}
+
+var modelStatsMap = make(map[string]*modelStats) // Model -> Counts, devices are filled in from discoverMap
+var modelStatsMutex = &sync.RWMutex{}
+
+func modelStatsFor(model string) *modelStats { // Must hold modelStatsMutex
+	s, ok := modelStatsMap[model]
+	if !ok {
+		s = &modelStats{}
+		modelStatsMap[model] = s
+	}
+	return s
+}
+
+func countModelAdvertisement(model string) {
+	modelStatsMutex.Lock()
+	defer modelStatsMutex.Unlock()
+	s := modelStatsFor(model)
+	s.Advertisements++
+	s.LastSeen = time.Now().Unix()
+}
+
+func countModelDecoded(model string) {
+	modelStatsMutex.Lock()
+	defer modelStatsMutex.Unlock()
+	modelStatsFor(model).Decoded++
+}
+
+func currentStats() *statsResponse {
+	stats := &statsResponse{Models: make(map[string]*modelStats), Uptime: time.Since(startTime).Seconds()}
+	modelStatsMutex.RLock()
+	for model, s := range modelStatsMap {
+		copied := *s
+		stats.Models[model] = &copied
+	}
+	modelStatsMutex.RUnlock()
+	discoverMutex.RLock()
+	for _, d := range discoverMap {
+		if s, ok := stats.Models[d.model]; ok {
+			s.Devices++
+		}
+		stats.Totals.Devices++
+	}
+	discoverMutex.RUnlock()
+	for _, s := range stats.Models {
+		stats.Totals.Advertisements += s.Advertisements
+		stats.Totals.Decoded += s.Decoded
+		if s.LastSeen > stats.Totals.LastSeen {
+			stats.Totals.LastSeen = s.LastSeen
+		}
+	}
+	return stats
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentStats())
+}
+
+func activeDevicesByModel() (int, map[string]int) { // Devices heard within -device-timeout
+	byModel := make(map[string]int)
+	total := 0
+	discoverMutex.RLock()
+	defer discoverMutex.RUnlock()
+	for _, d := range discoverMap {
+		if time.Since(d.last) < flagDeviceTimeout {
+			byModel[d.model]++
+			total++
+		}
+	}
+	return total, byModel
+}
+
+func summaryLine(total int, byModel map[string]int, advertisements int64, interval time.Duration) string {
+	models := make([]string, 0, len(byModel))
+	for model, count := range byModel {
+		if len(model) == 0 {
+			model = "Unparsed"
+		}
+		models = append(models, fmt.Sprintf("%s %d", model, count))
+	}
+	sort.Strings(models)
+	return fmt.Sprintf("Summary : %d active devices (%s), %d advertisements in the last %s", total, strings.Join(models, ", "), advertisements, interval)
+}
+
+func summaryLogPeriodically() { // A heartbeat in the logs, even when discovery lines are suppressed
+	ticker := time.NewTicker(flagSummaryInterval)
+	defer ticker.Stop()
+	var lastAdvertisements int64
+	for range ticker.C {
+		advertisements := currentStats().Totals.Advertisements
+		total, byModel := activeDevicesByModel()
+		logInfo("%s", summaryLine(total, byModel, advertisements-lastAdvertisements, flagSummaryInterval))
+		lastAdvertisements = advertisements
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// -tui redraws a table of the active devices in place, for watching a terminal
+// instead of scrolling log lines.
+
+const tuiRefreshInterval = time.Second
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func tuiStart() {
+	if !isTerminal(os.Stdout) {
+		logWarn("-tui needs a terminal on stdout, falling back to plain logging")
+		return
+	}
+	if len(flagLogFile) == 0 && isTerminal(os.Stderr) { // Log lines would scroll the table away, keep the errors (and log.Fatalf) only
+		setLogLevel(levelError)
+	}
+	go func() {
+		for {
+			tuiRender(os.Stdout)
+			time.Sleep(tuiRefreshInterval)
+		}
+	}()
+}
+
+func tuiValue(value *float64, format string) string {
+	if value == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, *value)
+}
+
+func tuiRender(out io.Writer) {
+	fmt.Fprint(out, "\033[H\033[2J") // Cursor home, clear screen
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s %s\t%s\n\n", applicationName, BuildVersion, time.Now().Format("15:04:05"))
+	fmt.Fprintln(w, "MAC\tNAME\tMODEL\tTEMP\tHUMIDITY\tBATTERY\tRSSI\tAGE")
+	for _, device := range listDevices() {
+		r := &device.reading
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", r.Mac, r.Name, r.Model,
+			tuiValue(r.TemperatureCelsius, "%.1fC"),
+			tuiValue(r.HumidityPercent, "%.1f%%"),
+			tuiValue(r.BatteryPercent, "%.0f%%"),
+			r.RSSI, time.Since(device.updated).Round(time.Second))
+	}
+	w.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/visago/ble"
+)
+
+// With -workers N the scan callback only copies the advertisement onto a queue, and N
+// workers run advScanHandler, so slow outputs (MQTT, json stdout) can't stall the scan
+// and a burst of advertisements can't spawn unbounded concurrent handlers.
+
+const workerQueueLength = 256 // Advertisements buffered per worker before dropping
+
+var advQueue chan ble.Advertisement
+
+var metricsAdvertisementDroppedCount = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "btle_exporter_advertisement_dropped_count",
+	Help: "The total number of advertisements dropped because the -workers queue was full",
+})
+
+type capturedAdvertisement struct { // Implements ble.Advertisement on copies, the library may reuse its buffers
+	addr             string
+	rssi             int
+	localName        string
+	connectable      bool
+	txPowerLevel     int
+	eventType        uint8
+	data             []byte
+	scanResponse     []byte
+	manufacturerData []byte
+	serviceData      []ble.ServiceData
+	services         []ble.UUID
+	overflowService  []ble.UUID
+	solicitedService []ble.UUID
+}
+
+func captureAdvertisement(a ble.Advertisement) *capturedAdvertisement {
+	c := &capturedAdvertisement{
+		addr:             a.Addr().String(),
+		rssi:             a.RSSI(),
+		localName:        a.LocalName(),
+		connectable:      a.Connectable(),
+		txPowerLevel:     a.TxPowerLevel(),
+		eventType:        a.EventType(),
+		data:             append([]byte(nil), a.Data()...),
+		scanResponse:     append([]byte(nil), a.ScanResponse()...),
+		manufacturerData: append([]byte(nil), a.ManufacturerData()...),
+		services:         copyUUIDs(a.Services()),
+		overflowService:  copyUUIDs(a.OverflowService()),
+		solicitedService: copyUUIDs(a.SolicitedService()),
+	}
+	for _, sd := range a.ServiceData() {
+		c.serviceData = append(c.serviceData, ble.ServiceData{UUID: append(ble.UUID(nil), sd.UUID...), Data: append([]byte(nil), sd.Data...)})
+	}
+	return c
+}
+
+func copyUUIDs(uuids []ble.UUID) []ble.UUID {
+	var copied []ble.UUID
+	for _, u := range uuids {
+		copied = append(copied, append(ble.UUID(nil), u...))
+	}
+	return copied
+}
+
+func (a *capturedAdvertisement) LocalName() string              { return a.localName }
+func (a *capturedAdvertisement) ManufacturerData() []byte       { return a.manufacturerData }
+func (a *capturedAdvertisement) ServiceData() []ble.ServiceData { return a.serviceData }
+func (a *capturedAdvertisement) Services() []ble.UUID           { return a.services }
+func (a *capturedAdvertisement) OverflowService() []ble.UUID    { return a.overflowService }
+func (a *capturedAdvertisement) TxPowerLevel() int              { return a.txPowerLevel }
+func (a *capturedAdvertisement) Connectable() bool              { return a.connectable }
+func (a *capturedAdvertisement) SolicitedService() []ble.UUID   { return a.solicitedService }
+func (a *capturedAdvertisement) ScanResponse() []byte           { return a.scanResponse }
+func (a *capturedAdvertisement) EventType() uint8               { return a.eventType }
+func (a *capturedAdvertisement) Data() []byte                   { return a.data }
+func (a *capturedAdvertisement) RSSI() int                      { return a.rssi }
+func (a *capturedAdvertisement) Addr() ble.Addr                 { return ble.NewAddr(a.addr) }
+
+func startWorkers(count int) {
+	advQueue = make(chan ble.Advertisement, count*workerQueueLength)
+	for i := 0; i < count; i++ {
+		go func() {
+			for a := range advQueue {
+				advScanHandler(a)
+			}
+		}()
+	}
+	logInfo("Processing advertisements with %d workers", count)
+}
+
+func dispatchAdvertisement(a ble.Advertisement) { // Hands the advertisement to a worker, or handles it inline without -workers
+	if advQueue == nil {
+		advScanHandler(a)
+		return
+	}
+	select {
+	case advQueue <- captureAdvertisement(a):
+	default: // Never block the scan, it would back up the adapter instead
+		metricsAdvertisementDroppedCount.Inc()
+	}
+}
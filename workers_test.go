@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/visago/ble"
+)
+
+type addressedDevice struct {
+	ble.Device
+	address string
+}
+
+func (d addressedDevice) Address() ble.Addr { return ble.NewAddr(d.address) }
+
+func TestAdapterInfo(t *testing.T) {
+	if got := adapterAddress(addressedDevice{address: "00:1A:7D:DA:71:13"}); got != "00:1a:7d:da:71:13" {
+		t.Errorf("got address %q, want 00:1a:7d:da:71:13", got)
+	}
+	if got := adapterAddress(struct{ ble.Device }{}); got != "" {
+		t.Errorf("got address %q from a backend without one, want empty", got)
+	}
+	setAdapterInfo("hci9", "00:1a:7d:da:71:13")
+	setAdapterInfo("hci9", "00:1a:7d:da:71:14") // Replugged with another dongle
+	if metricsAdapterInfoGauge.Delete(prometheus.Labels{"adapter": "hci9", "address": "00:1a:7d:da:71:13"}) {
+		t.Errorf("old address still exported")
+	}
+	if got := testutil.ToFloat64(metricsAdapterInfoGauge.With(prometheus.Labels{"adapter": "hci9", "address": "00:1a:7d:da:71:14"})); got != 1 {
+		t.Errorf("got %g for the new address, want 1", got)
+	}
+}
+
+func TestCaptureAdvertisement(t *testing.T) {
+	data := []byte{0x02, 0x01, 0x06}
+	a := &simulatedAdvertisement{addr: "aa:bb:cc:dd:ee:ff", rssi: -60, data: data, localName: "sensor"}
+	c := captureAdvertisement(a)
+	data[2] = 0xff // The library reusing its buffer
+	if !bytes.Equal(c.Data(), []byte{0x02, 0x01, 0x06}) {
+		t.Errorf("got data %x, want 020106", c.Data())
+	}
+	if c.Addr().String() != "aa:bb:cc:dd:ee:ff" || c.RSSI() != -60 || c.LocalName() != "sensor" {
+		t.Errorf("got %s %d %q", c.Addr(), c.RSSI(), c.LocalName())
+	}
+}
+
+func TestQueuedAdvertisementSurvivesBufferReuse(t *testing.T) {
+	defer func(queue chan ble.Advertisement) { advQueue = queue }(advQueue)
+	advQueue = make(chan ble.Advertisement, 1)               // No workers, the test plays the worker
+	buffer, _ := hex.DecodeString(simulatedFixtures[1].data) // ATC 24.4C
+	dispatchAdvertisement(&simulatedAdvertisement{addr: simulatedFixtures[1].mac, data: buffer})
+	other, _ := hex.DecodeString("02010610161a18a4c13800000200003c420bb80a") // ATC 0C, reusing the same buffer
+	copy(buffer, other)
+	got, err := parseAdvertisementReportData((<-advQueue).Data(), "")
+	if err != nil {
+		t.Fatalf("parse : %v", err)
+	}
+	if got.TemperatureCelsius != 24.4 {
+		t.Errorf("got temperature %g, want 24.4 from before the buffer was reused", got.TemperatureCelsius)
+	}
+}
+
+type panickingAdvertisement struct{ *simulatedAdvertisement }
+
+func (a *panickingAdvertisement) LocalName() string { panic("decoder bug") }
+
+func TestAdvScanHandlerRecoversFromPanic(t *testing.T) {
+	panics := testutil.ToFloat64(metricsHandlerPanicCount)
+	buffer, _ := hex.DecodeString(simulatedFixtures[1].data)
+	advScanHandler(&panickingAdvertisement{&simulatedAdvertisement{addr: "aa:bb:cc:dd:ee:40", data: buffer}}) // Must not propagate
+	if got := testutil.ToFloat64(metricsHandlerPanicCount) - panics; got != 1 {
+		t.Errorf("got %g panics counted, want 1", got)
+	}
+}
+
+func TestScanWatchdog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	last := time.Now().UnixNano()
+	var deaf int32
+	done := make(chan struct{})
+	go func() {
+		scanWatchdog(ctx, cancel, &last, &deaf, 50*time.Millisecond)
+		close(done)
+	}()
+	for i := 0; i < 5; i++ { // Kept alive by advertisements
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt64(&last, time.Now().UnixNano())
+	}
+	if atomic.LoadInt32(&deaf) != 0 || ctx.Err() != nil {
+		t.Fatalf("fired while advertisements arrived")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("didn't fire once advertisements stopped")
+	}
+	if atomic.LoadInt32(&deaf) != 1 || ctx.Err() == nil {
+		t.Errorf("got deaf %d, scan context %v", deaf, ctx.Err())
+	}
+}